@@ -95,13 +95,36 @@ func (addrs AddrList) String() string {
 }
 
 func (addrs AddrList) Filter() string {
+	return addrs.filter([]string{"dst"})
+}
+
+func (addrs AddrList) FilterWithResponses() string {
+	return addrs.filter([]string{"dst", "src"})
+}
+
+func (addrs AddrList) filter(directions []string) string {
 	var parts []string
 	for _, addr := range addrs {
-		parts = append(parts, fmt.Sprintf("(dst host %s and tcp dst port %d)", addr.IP, addr.Port))
+		for _, dir := range directions {
+			if addr.IP == nil {
+				parts = append(parts, fmt.Sprintf("(tcp %s port %d)", dir, addr.Port))
+			} else {
+				parts = append(parts, fmt.Sprintf("(%s host %s and tcp %s port %d)", dir, addr.IP, dir, addr.Port))
+			}
+		}
 	}
 	return strings.Join(parts, " or ")
 }
 
+func (addrs AddrList) Contains(ip net.IP, port int) bool {
+	for _, addr := range addrs {
+		if addr.Port == port && (addr.IP == nil || addr.IP.Equal(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (addrs AddrList) RequiresPromisc() bool {
 	ips, err := net.InterfaceAddrs()
 	if err != nil {
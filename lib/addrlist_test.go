@@ -16,6 +16,34 @@ func TestAddrFilter(t *testing.T) {
 	assert.Equal(t, addrs.Filter(), "(dst host ::1 and tcp dst port 80) or (dst host ::1 and tcp dst port 443)")
 }
 
+func TestAddrFilterWildcard(t *testing.T) {
+	addrs := AddrList{
+		&net.TCPAddr{IP: nil, Port: 80},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080},
+	}
+	assert.Equal(t, addrs.Filter(), "(tcp dst port 80) or (dst host 127.0.0.1 and tcp dst port 8080)")
+}
+
+func TestAddrFilterWithResponses(t *testing.T) {
+	addrs := AddrList{
+		&net.TCPAddr{IP: net.IPv6loopback, Port: 80},
+		&net.TCPAddr{IP: nil, Port: 8080},
+	}
+	assert.Equal(t, addrs.FilterWithResponses(), "(dst host ::1 and tcp dst port 80) or (src host ::1 and tcp src port 80) or "+
+		"(tcp dst port 8080) or (tcp src port 8080)")
+}
+
+func TestAddrContains(t *testing.T) {
+	addrs := AddrList{
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+		&net.TCPAddr{IP: nil, Port: 8080},
+	}
+	assert.Equal(t, addrs.Contains(net.IPv4(127, 0, 0, 1), 80), true)
+	assert.Equal(t, addrs.Contains(net.IPv4(127, 0, 0, 1), 443), false)
+	assert.Equal(t, addrs.Contains(net.IPv4(10, 0, 0, 1), 80), false)
+	assert.Equal(t, addrs.Contains(net.IPv4(10, 0, 0, 1), 8080), true)
+}
+
 func TestAddrString(t *testing.T) {
 	addrs := AddrList{
 		&net.TCPAddr{IP: net.IPv6loopback, Port: 80},
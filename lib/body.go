@@ -0,0 +1,221 @@
+package httap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	SpoolBody    = "spool"
+	TruncateBody = "truncate"
+	SkipBody     = "skip"
+)
+
+const streamBufferSize = 1 << 20
+
+var errStreamOverflow = errors.New("destination is not keeping up with streamed body")
+
+type Body struct {
+	Truncated bool
+	Skipped   bool
+	data      []byte
+	file      *os.File
+	size      int64
+	refs      int32
+}
+
+func NewBody(data []byte) *Body {
+	return &Body{data: data, size: int64(len(data)), refs: 1}
+}
+
+type bodyWriter struct {
+	body   *Body
+	max    int64
+	policy string
+	buf    bytes.Buffer
+	err    error
+}
+
+func newBodyWriter(max int64, policy string) *bodyWriter {
+	return &bodyWriter{body: &Body{refs: 1}, max: max, policy: policy}
+}
+
+func ReadBody(reader io.Reader, max int64, policy string) (*Body, error) {
+	w := newBodyWriter(max, policy)
+
+	/* Everything is consumed, the stream continues after the body. */
+	_, err := io.Copy(w, reader)
+	if err == nil {
+		err = w.err
+	}
+	return w.finish(), err
+}
+
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	body := w.body
+	switch {
+	case body.Skipped || body.Truncated:
+	case body.file != nil:
+		n, err := body.file.Write(p)
+		body.size += int64(n)
+		if err != nil {
+			w.skip(err)
+		}
+	case w.max <= 0 || int64(w.buf.Len()+len(p)) <= w.max:
+		w.buf.Write(p)
+	case w.policy == SkipBody:
+		w.skip(nil)
+	case w.policy == TruncateBody:
+		w.buf.Write(p[:w.max-int64(w.buf.Len())])
+		body.Truncated = true
+	default:
+		if w.spool() {
+			return w.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (w *bodyWriter) spool() bool {
+	file, err := ioutil.TempFile("", "httap-body")
+	if err != nil {
+		w.skip(err)
+		return false
+	}
+
+	/* The file remains accessible until it is closed, and is never left
+	   behind if httap exits. */
+	os.Remove(file.Name())
+
+	w.body.file = file
+	w.Write(w.buf.Bytes())
+	w.buf = bytes.Buffer{}
+	return w.body.file != nil
+}
+
+func (w *bodyWriter) skip(err error) {
+	body := w.body
+	if body.file != nil {
+		body.file.Close()
+		body.file = nil
+	}
+	body.Skipped = true
+	body.size = 0
+	w.buf = bytes.Buffer{}
+	w.err = err
+}
+
+func (w *bodyWriter) finish() *Body {
+	if w.body.file == nil {
+		w.body.data = w.buf.Bytes()
+		w.body.size = int64(len(w.body.data))
+	}
+	return w.body
+}
+
+func (body *Body) Len() int64 {
+	return body.size
+}
+
+func (body *Body) Reader() io.Reader {
+	if body.file != nil {
+		return io.NewSectionReader(body.file, 0, body.size)
+	}
+	return bytes.NewReader(body.data)
+}
+
+func (body *Body) Bytes() []byte {
+	return body.Head(0)
+}
+
+func (body *Body) Head(max int64) []byte {
+	if max <= 0 || max > body.size {
+		max = body.size
+	}
+	if body.file == nil {
+		return body.data[:max]
+	}
+
+	data := make([]byte, max)
+	n, _ := io.ReadFull(body.Reader(), data)
+	return data[:n]
+}
+
+func (body *Body) retain() {
+	atomic.AddInt32(&body.refs, 1)
+}
+
+func (body *Body) release() {
+	if atomic.AddInt32(&body.refs, -1) == 0 && body.file != nil {
+		body.file.Close()
+	}
+}
+
+type streamBody struct {
+	buffered int64
+	chunks   chan []byte
+	chunk    []byte
+	err      error
+	done     chan struct{}
+	closed   sync.Once
+}
+
+func newStreamBody() *streamBody {
+	return &streamBody{chunks: make(chan []byte, 1024), done: make(chan struct{})}
+}
+
+func (sb *streamBody) Write(p []byte) (int, error) {
+	select {
+	case <-sb.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	/* Never wait for the destination, capturing must continue regardless. */
+	if atomic.AddInt64(&sb.buffered, int64(len(p))) > streamBufferSize {
+		return 0, errStreamOverflow
+	}
+
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	select {
+	case sb.chunks <- chunk:
+		return len(p), nil
+	default:
+		return 0, errStreamOverflow
+	}
+}
+
+func (sb *streamBody) CloseWithError(err error) {
+	sb.err = err
+	close(sb.chunks)
+}
+
+func (sb *streamBody) Read(p []byte) (int, error) {
+	if len(sb.chunk) == 0 {
+		chunk, ok := <-sb.chunks
+		if !ok {
+			if sb.err != nil {
+				return 0, sb.err
+			}
+			return 0, io.EOF
+		}
+		sb.chunk = chunk
+	}
+
+	n := copy(p, sb.chunk)
+	sb.chunk = sb.chunk[n:]
+	atomic.AddInt64(&sb.buffered, -int64(n))
+	return n, nil
+}
+
+func (sb *streamBody) Close() error {
+	sb.closed.Do(func() { close(sb.done) })
+	return nil
+}
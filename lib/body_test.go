@@ -0,0 +1,60 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"io/ioutil"
+	"strings"
+)
+
+func TestReadBodyWithinLimit(t *testing.T) {
+	body, err := ReadBody(strings.NewReader("FOO BAR BAZ"), 11, SkipBody)
+
+	assert.Nil(t, err)
+	assert.False(t, body.Skipped)
+	assert.False(t, body.Truncated)
+	assert.Equal(t, string(body.Bytes()), "FOO BAR BAZ")
+}
+
+func TestReadBodyTruncate(t *testing.T) {
+	reader := strings.NewReader("FOO BAR BAZ")
+	body, err := ReadBody(reader, 7, TruncateBody)
+
+	assert.Nil(t, err)
+	assert.True(t, body.Truncated)
+	assert.Equal(t, body.Len(), int64(7))
+	assert.Equal(t, string(body.Bytes()), "FOO BAR")
+	assert.Equal(t, reader.Len(), 0)
+}
+
+func TestReadBodySkip(t *testing.T) {
+	reader := strings.NewReader("FOO BAR BAZ")
+	body, err := ReadBody(reader, 7, SkipBody)
+
+	assert.Nil(t, err)
+	assert.True(t, body.Skipped)
+	assert.Equal(t, reader.Len(), 0)
+}
+
+func TestReadBodySpool(t *testing.T) {
+	body, err := ReadBody(strings.NewReader("FOO BAR BAZ"), 3, SpoolBody)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, body.file)
+	assert.Equal(t, body.Len(), int64(11))
+
+	body.retain()
+	first, _ := ioutil.ReadAll(body.Reader())
+	second, _ := ioutil.ReadAll(body.Reader())
+	assert.Equal(t, string(first), "FOO BAR BAZ")
+	assert.Equal(t, string(second), "FOO BAR BAZ")
+
+	body.release()
+	assert.Equal(t, string(body.Bytes()), "FOO BAR BAZ")
+	assert.Equal(t, string(body.Head(3)), "FOO")
+
+	body.release()
+	_, err = body.file.Stat()
+	assert.NotNil(t, err)
+}
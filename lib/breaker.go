@@ -0,0 +1,128 @@
+package httap
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+type Breaker struct {
+	Threshold   float64
+	Latency     time.Duration
+	Cooldown    time.Duration
+	MinRequests int
+	Probes      int
+	Window      time.Duration
+	OnChange    func(state string)
+	state       string
+	requests    int
+	failures    int
+	probing     int
+	since       time.Time
+	mutex       sync.Mutex
+}
+
+func NewBreaker(threshold float64) *Breaker {
+	return &Breaker{
+		Threshold:   threshold,
+		Cooldown:    30 * time.Second,
+		MinRequests: 20,
+		Probes:      5,
+		Window:      10 * time.Second,
+		state:       BreakerClosed,
+		since:       time.Now(),
+	}
+}
+
+func (b *Breaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+func (b *Breaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.Threshold <= 0 {
+		return true
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.since) < b.Cooldown {
+			return false
+		}
+		b.transition(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		/* Only a trickle of requests probes whether the destination has
+		   recovered. */
+		if b.probing >= b.Probes {
+			return false
+		}
+		b.probing++
+	}
+	return true
+}
+
+func (b *Breaker) release() {
+	/* Gives back a probe that was allowed, but never sent. */
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+}
+
+func (b *Breaker) Record(success bool, latency time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.Threshold <= 0 {
+		return
+	}
+
+	if b.Latency > 0 && latency > b.Latency {
+		success = false
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		if time.Since(b.since) > b.Window {
+			b.requests, b.failures = 0, 0
+			b.since = time.Now()
+		}
+
+		b.requests++
+		if !success {
+			b.failures++
+		}
+
+		if b.requests >= b.MinRequests && float64(b.failures)/float64(b.requests) >= b.Threshold {
+			b.transition(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		if !success {
+			b.transition(BreakerOpen)
+		} else if b.requests++; b.requests >= b.Probes {
+			b.transition(BreakerClosed)
+		}
+	}
+}
+
+func (b *Breaker) transition(state string) {
+	b.state = state
+	b.since = time.Now()
+	b.requests, b.failures, b.probing = 0, 0, 0
+
+	if b.OnChange != nil {
+		b.OnChange(state)
+	}
+}
@@ -0,0 +1,91 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"time"
+)
+
+func openBreaker(b *Breaker) {
+	for i := 0; i < b.MinRequests; i++ {
+		b.Allow()
+		b.Record(false, 0)
+	}
+}
+
+func TestBreakerOpensOnErrors(t *testing.T) {
+	var states []string
+	b := NewBreaker(0.5)
+	b.OnChange = func(state string) { states = append(states, state) }
+
+	for i := 0; i < b.MinRequests-1; i++ {
+		b.Record(i%2 == 0, 0)
+	}
+	assert.Equal(t, b.State(), BreakerClosed)
+
+	b.Record(false, 0)
+	assert.Equal(t, b.State(), BreakerOpen)
+	assert.False(t, b.Allow())
+	assert.Equal(t, states, []string{BreakerOpen})
+}
+
+func TestBreakerProbesAfterCooldown(t *testing.T) {
+	var states []string
+	b := NewBreaker(0.5)
+	b.OnChange = func(state string) { states = append(states, state) }
+	b.Cooldown = 0
+	openBreaker(b)
+
+	for i := 0; i < b.Probes; i++ {
+		assert.True(t, b.Allow())
+	}
+	assert.False(t, b.Allow())
+	assert.Equal(t, b.State(), BreakerHalfOpen)
+
+	for i := 0; i < b.Probes; i++ {
+		b.Record(true, 0)
+	}
+	assert.Equal(t, b.State(), BreakerClosed)
+	assert.Equal(t, states, []string{BreakerOpen, BreakerHalfOpen, BreakerClosed})
+}
+
+func TestBreakerReopensOnFailedProbe(t *testing.T) {
+	b := NewBreaker(0.5)
+	b.Cooldown = 0
+	openBreaker(b)
+
+	assert.True(t, b.Allow())
+	b.Record(false, 0)
+	assert.Equal(t, b.State(), BreakerOpen)
+}
+
+func TestBreakerCountsSlowRequestsAsFailures(t *testing.T) {
+	b := NewBreaker(0.5)
+	b.Latency = time.Second
+
+	for i := 0; i < b.MinRequests; i++ {
+		b.Record(true, 2*time.Second)
+	}
+	assert.Equal(t, b.State(), BreakerOpen)
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := NewBreaker(0)
+	openBreaker(b)
+
+	assert.Equal(t, b.State(), BreakerClosed)
+	assert.True(t, b.Allow())
+}
+
+func TestBreakerReleasesUnsentProbes(t *testing.T) {
+	b := NewBreaker(0.5)
+	b.Cooldown = 0
+	openBreaker(b)
+
+	for i := 0; i < b.Probes; i++ {
+		assert.True(t, b.Allow())
+		b.release()
+	}
+	assert.True(t, b.Allow())
+}
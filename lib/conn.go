@@ -0,0 +1,95 @@
+package httap
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Conn struct {
+	pending []*Exchange
+	closed  bool
+	refs    int
+	tls     *tlsSession
+	mutex   sync.Mutex
+}
+
+type Exchange struct {
+	Request  *http.Request
+	Response *Response
+	done     chan struct{}
+}
+
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Truncated  bool
+}
+
+func (conn *Conn) push(req *http.Request) *Exchange {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	ex := newExchange(req)
+	if conn.closed {
+		close(ex.done)
+	} else {
+		conn.pending = append(conn.pending, ex)
+	}
+	return ex
+}
+
+func (conn *Conn) tlsSession(keys *KeyLog) *tlsSession {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.tls == nil {
+		conn.tls = newTLSSession(keys)
+	}
+	return conn.tls
+}
+
+func (conn *Conn) next() *Exchange {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	/* Requests are always parsed before their responses arrive, because the
+	   assembler blocks until each stream has consumed the data it was given. */
+	if len(conn.pending) == 0 {
+		return nil
+	}
+
+	ex := conn.pending[0]
+	conn.pending = conn.pending[1:]
+	return ex
+}
+
+func (conn *Conn) close() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for _, ex := range conn.pending {
+		close(ex.done)
+	}
+	conn.pending = nil
+	conn.closed = true
+}
+
+func newExchange(req *http.Request) *Exchange {
+	return &Exchange{Request: req, done: make(chan struct{})}
+}
+
+func (ex *Exchange) complete(res *Response) {
+	ex.Response = res
+	close(ex.done)
+}
+
+func (ex *Exchange) Wait(timeout time.Duration) *Response {
+	select {
+	case <-ex.done:
+		return ex.Response
+	case <-time.After(timeout):
+		return nil
+	}
+}
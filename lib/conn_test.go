@@ -0,0 +1,92 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"net/http"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+func TestResponseStreamPairsPipelinedResponses(t *testing.T) {
+	tap := NewWiretap(Options{Diff: true})
+	conn := new(Conn)
+
+	get := conn.push(&http.Request{Method: "GET"})
+	head := conn.push(&http.Request{Method: "HEAD"})
+	post := conn.push(&http.Request{Method: "POST"})
+
+	stream := NewResponseStream(tap, gopacket.Flow{}, conn)
+	go stream.Consume()
+
+	stream.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n" +
+			"HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok")}})
+	stream.ReassemblyComplete()
+
+	res := get.Wait(time.Second)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, string(res.Body), "hello")
+
+	res = head.Wait(time.Second)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, res.Header.Get("Content-Length"), "5")
+	assert.Equal(t, len(res.Body), 0)
+
+	res = post.Wait(time.Second)
+	assert.Equal(t, res.StatusCode, 201)
+	assert.Equal(t, string(res.Body), "ok")
+}
+
+func TestResponseStreamLimitsBodies(t *testing.T) {
+	conn := new(Conn)
+	ex := conn.push(&http.Request{Method: "GET"})
+
+	stream := NewResponseStream(NewWiretap(Options{}), gopacket.Flow{}, conn)
+	go stream.Consume()
+	stream.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")}})
+	stream.ReassemblyComplete()
+
+	res := ex.Wait(time.Second)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, len(res.Body), 0)
+
+	conn = new(Conn)
+	get := conn.push(&http.Request{Method: "GET"})
+	post := conn.push(&http.Request{Method: "POST"})
+
+	stream = NewResponseStream(NewWiretap(Options{Diff: true, MaxBody: 3}), gopacket.Flow{}, conn)
+	go stream.Consume()
+	stream.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+			"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok")}})
+	stream.ReassemblyComplete()
+
+	res = get.Wait(time.Second)
+	assert.Equal(t, string(res.Body), "hel")
+	assert.True(t, res.Truncated)
+
+	res = post.Wait(time.Second)
+	assert.Equal(t, res.StatusCode, 201)
+	assert.Equal(t, string(res.Body), "ok")
+	assert.False(t, res.Truncated)
+}
+
+func TestConnCompletesPendingExchangesOnClose(t *testing.T) {
+	conn := new(Conn)
+
+	ex := conn.push(&http.Request{Method: "GET"})
+	assert.Nil(t, ex.Wait(10*time.Millisecond))
+
+	conn.close()
+	assert.Nil(t, ex.Wait(time.Second))
+	assert.Nil(t, conn.next())
+
+	ex = conn.push(&http.Request{Method: "GET"})
+	assert.Nil(t, ex.Wait(time.Second))
+}
@@ -0,0 +1,507 @@
+package httap
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var errHeaderTimeout = errors.New("timeout awaiting response headers")
+
+const maxBackoff = 30 * time.Second
+
+type Role int
+
+const (
+	CandidateRole Role = iota
+	BaselineRole
+)
+
+type Destination struct {
+	Dropped int64 /* First for 64-bit alignment of atomic operations. */
+	*net.TCPAddr
+	Role        Role
+	Scheme      string
+	ServerName  string
+	Transport   http.RoundTripper
+	H2Transport http.RoundTripper
+	HTTP2       bool
+	TLSConfig   *tls.Config
+	Requests    *TokenBucket
+	Bytes       *TokenBucket
+	Queue       *Queue
+	Breaker     *Breaker
+	Weight      float64
+
+	DialTimeout   time.Duration
+	TLSTimeout    time.Duration
+	HeaderTimeout time.Duration
+	Timeout       time.Duration
+	Retries       int
+	Backoff       time.Duration
+}
+
+type DestinationList []*Destination
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+type dialError struct {
+	error
+}
+
+const DestinationHelp = `Destination options, appended to a destination as HOST:PORT,OPTION=VALUE,...:
+  rps=N                Forward at most N requests per second
+  bps=N                Forward at most N bytes of request bodies per second
+  workers=N            Send at most N requests at the same time (16)
+  queue=N              Queue at most N requests waiting to be sent (1000)
+  drop=newest|oldest   Request to drop when the queue is full (newest)
+  dial-timeout=D       Give up connecting after D (5s)
+  tls-timeout=D        Give up on the TLS handshake after D (5s)
+  header-timeout=D     Give up waiting for response headers after D (30s)
+  timeout=D            Give up on a request after D, including retries (1m)
+  retries=N            Retry a request N times when connecting to the destination fails (0)
+  backoff=D            Wait D before retrying, doubling each time up to 30s (100ms)
+  weight=N             Split requests among weighted destinations by weight (none)
+  breaker=RATE         Stop sending when this fraction of requests fails to connect or times out (0, never)
+  breaker-latency=D    Count requests slower than D as failed (none)
+  cooldown=D           Stop sending for D before probing the destination again (30s)`
+
+type DestinationOptions struct {
+	DstCA         string `long:"dst-ca"          description:"Verify HTTPS destinations with CA certificates from a PEM bundle." value-name:"FILE"`
+	DstCert       string `long:"dst-cert"        description:"Present a client certificate from a PEM file to HTTPS destinations." value-name:"FILE"`
+	DstKey        string `long:"dst-key"         description:"Private key for the client certificate, in a PEM file." value-name:"FILE"`
+	DstServerName string `long:"dst-server-name" description:"Server name to send and verify for HTTPS destinations." value-name:"NAME"`
+	DstInsecure   bool   `long:"dst-insecure"    description:"Do not verify certificates of HTTPS destinations."`
+	DstHTTP2      bool   `long:"dst-http2"       description:"Forward requests over HTTP/2, negotiated with ALPN for HTTPS and with prior knowledge otherwise."`
+}
+
+func ResolveDestinations(strs []string, role Role) (dsts DestinationList, err error) {
+	for _, str := range strs {
+		/* Destinations may be followed by options, as in HOST:PORT,key=value. */
+		params := strings.Split(str, ",")
+		str = params[0]
+
+		scheme := "http"
+		if strings.HasPrefix(str, "https://") {
+			scheme = "https"
+		}
+
+		str = strings.TrimPrefix(strings.TrimPrefix(str, "http://"), "https://")
+		if scheme == "https" && !hasPort(str) {
+			str = str + ":443"
+		}
+
+		addrs, err := ResolveAddrList([]string{str})
+		if err != nil {
+			return nil, err
+		}
+
+		/* Certificates are issued for host names, not for resolved IPs. */
+		host, _ := splitAddr(str)
+		if net.ParseIP(host) != nil {
+			host = ""
+		}
+
+		for _, addr := range addrs {
+			dst := &Destination{
+				TCPAddr:       addr,
+				Role:          role,
+				Scheme:        scheme,
+				ServerName:    host,
+				Queue:         NewQueue(16, 1000, false),
+				Breaker:       NewBreaker(0),
+				DialTimeout:   5 * time.Second,
+				TLSTimeout:    5 * time.Second,
+				HeaderTimeout: 30 * time.Second,
+				Timeout:       time.Minute,
+				Backoff:       100 * time.Millisecond,
+			}
+			for _, param := range params[1:] {
+				if err := dst.set(param); err != nil {
+					return nil, err
+				}
+			}
+			dsts = append(dsts, dst)
+		}
+	}
+	return
+}
+
+func (dst *Destination) set(param string) error {
+	parts := strings.SplitN(param, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid destination option %q, use key=value", param)
+	}
+
+	key, value := parts[0], parts[1]
+	switch key {
+	case "rps", "bps":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid destination option %q, must be a positive number", param)
+		}
+		if key == "rps" {
+			dst.Requests = NewTokenBucket(rate)
+		} else {
+			dst.Bytes = NewTokenBucket(rate)
+		}
+	case "workers", "queue":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid destination option %q, must be a positive integer", param)
+		}
+		if key == "workers" {
+			dst.Queue = NewQueue(n, dst.Queue.Size, dst.Queue.DropOldest)
+		} else {
+			dst.Queue = NewQueue(dst.Queue.Workers, n, dst.Queue.DropOldest)
+		}
+	case "drop":
+		if value != "newest" && value != "oldest" {
+			return fmt.Errorf("invalid destination option %q, must be newest or oldest", param)
+		}
+		dst.Queue = NewQueue(dst.Queue.Workers, dst.Queue.Size, value == "oldest")
+	case "breaker":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid destination option %q, must be between 0 and 1", param)
+		}
+		dst.Breaker.Threshold = rate
+	case "weight":
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("invalid destination option %q, must be a positive number", param)
+		}
+		dst.Weight = weight
+	case "retries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid destination option %q, must be a non-negative integer", param)
+		}
+		dst.Retries = n
+	case "dial-timeout", "tls-timeout", "header-timeout", "timeout", "backoff", "breaker-latency", "cooldown":
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid destination option %q, must be a duration", param)
+		}
+		switch key {
+		case "dial-timeout":
+			dst.DialTimeout = duration
+		case "tls-timeout":
+			dst.TLSTimeout = duration
+		case "header-timeout":
+			dst.HeaderTimeout = duration
+		case "timeout":
+			dst.Timeout = duration
+		case "backoff":
+			dst.Backoff = duration
+		case "breaker-latency":
+			dst.Breaker.Latency = duration
+		case "cooldown":
+			dst.Breaker.Cooldown = duration
+		}
+	default:
+		return fmt.Errorf("unknown destination option %q", key)
+	}
+	return nil
+}
+
+func (dsts DestinationList) Route(point float64) (routed DestinationList) {
+	/* Weighted destinations share the traffic, each request is sent to
+	   exactly one of them. Other destinations receive all requests. */
+	var total float64
+	for _, dst := range dsts {
+		if dst.Role == CandidateRole {
+			total += dst.Weight
+		}
+	}
+
+	point *= total
+	for _, dst := range dsts {
+		if dst.Weight == 0 || dst.Role != CandidateRole {
+			routed = append(routed, dst)
+		} else if point -= dst.Weight; point < 0 {
+			routed = append(routed, dst)
+			point = total
+		}
+	}
+	return
+}
+
+func (dst *Destination) admit(req *http.Request) bool {
+	/* The breaker goes first, so that requests it rejects do not use up the
+	   rate limits. */
+	if !dst.Breaker.Allow() {
+		return false
+	}
+	if !dst.allow(req) {
+		dst.Breaker.release()
+		return false
+	}
+	return true
+}
+
+func (dst *Destination) allow(req *http.Request) bool {
+	if dst.Requests != nil && !dst.Requests.Take(1) {
+		return false
+	}
+
+	/* Bodies of unknown length are charged once they have been read. */
+	if dst.Bytes != nil && req.ContentLength > 0 && !dst.Bytes.Take(float64(req.ContentLength)) {
+		if dst.Requests != nil {
+			dst.Requests.Return(1)
+		}
+		return false
+	}
+	return true
+}
+
+func (dst *Destination) charge(n int64) {
+	if dst.Bytes != nil && n > 0 {
+		dst.Bytes.Charge(float64(n))
+	}
+}
+
+func (dsts DestinationList) Configure(opts DestinationOptions) error {
+	config, err := newTLSConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	for _, dst := range dsts {
+		dstConfig := config.Clone()
+		if dstConfig.ServerName == "" {
+			dstConfig.ServerName = dst.ServerName
+		}
+
+		/* Both transports connect through the destination, so that requests
+		   that were never sent can be told apart and retried. */
+		dst.Transport = &http.Transport{
+			Dial:                  dst.dialHTTP,
+			DialTLS:               dst.dialHTTP,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: dst.HeaderTimeout,
+		}
+		dst.H2Transport = dst.newH2Transport(dstConfig)
+		dst.HTTP2 = opts.DstHTTP2
+		dst.TLSConfig = dstConfig
+	}
+	return nil
+}
+
+func (dst *Destination) newH2Transport(config *tls.Config) *http2.Transport {
+	/* Speak HTTP/2 with prior knowledge (h2c) to plain destinations. */
+	return &http2.Transport{
+		TLSClientConfig: config,
+		AllowHTTP:       dst.Scheme == "http",
+		DialTLS:         dst.dialH2,
+	}
+}
+
+func (dst *Destination) RoundTrip(req *http.Request) (*http.Response, error) {
+	/* Protocol upgrades only exist in HTTP/1.1. */
+	if isGRPC(req) || dst.HTTP2 && req.Header.Get("Upgrade") == "" {
+		return dst.roundTripH2(withoutConnHeaders(req))
+	}
+	return dst.Transport.RoundTrip(req)
+}
+
+func (dst *Destination) roundTripH2(req *http.Request) (*http.Response, error) {
+	if dst.HeaderTimeout <= 0 {
+		return dst.H2Transport.RoundTrip(req)
+	}
+
+	/* The HTTP/2 transport has no response header timeout of its own. The
+	   request is cancelled if no response arrives in time, or otherwise when
+	   its body is closed. */
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(dst.HeaderTimeout, cancel)
+
+	res, err := dst.H2Transport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && err != nil && req.Context().Err() == nil {
+		err = errHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = &cancelBody{res.Body, cancel}
+	return res, nil
+}
+
+func (dst *Destination) Send(req *http.Request, body *Body) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := dst.RoundTrip(req)
+
+		/* Only requests that never reached the destination are sent again,
+		   anything else might not be safe to repeat. */
+		if _, ok := err.(*dialError); !ok || attempt >= dst.Retries || body == nil || req.Context().Err() != nil {
+			return res, err
+		}
+
+		select {
+		case <-time.After(dst.backoff(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		req.Body = ioutil.NopCloser(body.Reader())
+	}
+}
+
+func (dst *Destination) backoff(attempt int) time.Duration {
+	/* Doubling stops at the limit, long before it could overflow. */
+	backoff := dst.Backoff
+	for i := 0; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff && dst.Backoff <= maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+func (dst *Destination) Dial(addr string) (net.Conn, error) {
+	return dst.dial("tcp", addr, dst.TLSConfig)
+}
+
+func (dst *Destination) dialHTTP(network, addr string) (net.Conn, error) {
+	return dst.dial(network, addr, dst.TLSConfig)
+}
+
+func (dst *Destination) dial(network, addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, addr, dst.DialTimeout)
+	if err != nil {
+		return nil, &dialError{err}
+	}
+	if dst.Scheme != "https" {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, config)
+	conn.SetDeadline(time.Now().Add(dst.TLSTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &dialError{err}
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (dst *Destination) dialH2(network, addr string, config *tls.Config) (net.Conn, error) {
+	if dst.Scheme == "https" {
+		/* Servers that reject unknown protocols still complete the handshake,
+		   so that the error below can be reported. */
+		config = config.Clone()
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+
+	conn, err := dst.dial(network, addr, config)
+	if err != nil || dst.Scheme != "https" {
+		return conn, err
+	}
+
+	/* The transport does not check the negotiated protocol of connections
+	   from a custom dialer. */
+	if proto := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("destination %s does not support HTTP/2 over TLS", dst)
+	}
+	return conn, nil
+}
+
+func withoutConnHeaders(req *http.Request) *http.Request {
+	if _, ok := req.Header["Connection"]; !ok {
+		return req
+	}
+
+	/* Headers are shared between all copies of a request. */
+	header := make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		if key != "Connection" && key != "Keep-Alive" && key != "Proxy-Connection" {
+			header[key] = values
+		}
+	}
+
+	copy := *req
+	copy.Header = header
+	return &copy
+}
+
+func newTLSConfig(opts DestinationOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         opts.DstServerName,
+		InsecureSkipVerify: opts.DstInsecure,
+	}
+
+	if opts.DstCA != "" {
+		pem, err := ioutil.ReadFile(opts.DstCA)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + opts.DstCA)
+		}
+	}
+
+	if opts.DstCert != "" || opts.DstKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.DstCert, opts.DstKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func (dst *Destination) String() string {
+	str := dst.TCPAddr.String()
+	if dst.Scheme == "https" {
+		str = "https://" + str
+	}
+	if dst.Role == BaselineRole {
+		str = str + " (baseline)"
+	}
+	return str
+}
+
+func (dsts DestinationList) Has(role Role) bool {
+	for _, dst := range dsts {
+		if dst.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (dsts DestinationList) String() string {
+	var parts []string
+	for _, dst := range dsts {
+		parts = append(parts, dst.String())
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,268 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+func TestResolveDestinations(t *testing.T) {
+	dsts, err := ResolveDestinations([]string{"127.0.0.1:8080", "http://127.0.0.1", "https://localhost"}, CandidateRole)
+	if assert.Nil(t, err) && assert.Len(t, dsts, 3) {
+		assert.Equal(t, dsts[0].String(), "127.0.0.1:8080")
+		assert.Equal(t, dsts[0].Scheme, "http")
+		assert.Equal(t, dsts[1].String(), "127.0.0.1:80")
+		assert.Equal(t, dsts[2].Scheme, "https")
+		assert.Equal(t, dsts[2].Port, 443)
+		assert.Equal(t, dsts[2].ServerName, "localhost")
+	}
+}
+
+func TestConfigureDestinations(t *testing.T) {
+	dsts, _ := ResolveDestinations([]string{"https://127.0.0.1:8443", "https://localhost:8443"}, CandidateRole)
+	assert.Nil(t, dsts.Configure(DestinationOptions{DstInsecure: true}))
+
+	config := dsts[0].TLSConfig
+	assert.True(t, config.InsecureSkipVerify)
+	assert.Equal(t, config.ServerName, "")
+	assert.Equal(t, dsts[1].TLSConfig.ServerName, "localhost")
+
+	assert.Nil(t, dsts.Configure(DestinationOptions{DstServerName: "example.com"}))
+	assert.Equal(t, dsts[1].TLSConfig.ServerName, "example.com")
+
+	assert.NotNil(t, dsts.Configure(DestinationOptions{DstCA: "/nonexistent"}))
+}
+
+func TestDestinationForwardsOverHTTP2(t *testing.T) {
+	listener, reqs := createH2CChannel()
+	defer listener.Close()
+
+	dsts, _ := ResolveDestinations([]string{listener.Addr().String()}, CandidateRole)
+	dsts.Configure(DestinationOptions{DstHTTP2: true})
+
+	req, _ := http.NewRequest("GET", "http://"+listener.Addr().String()+"/foo", nil)
+	req.Header.Set("Connection", "keep-alive, x-custom")
+
+	res, err := dsts[0].RoundTrip(req)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+		copy := <-reqs
+		assert.Equal(t, copy.ProtoMajor, 2)
+		assert.Equal(t, copy.URL.Path, "/foo")
+	}
+	assert.Equal(t, req.Header.Get("Connection"), "keep-alive, x-custom")
+}
+
+func TestDestinationRequiresNegotiatedHTTP2(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	dsts, _ := ResolveDestinations([]string{"https://" + host}, CandidateRole)
+	dsts.Configure(DestinationOptions{DstInsecure: true, DstHTTP2: true})
+
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	_, err := dsts[0].RoundTrip(req)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "does not support HTTP/2")
+	}
+
+	server = httptest.NewUnstartedServer(server.Config.Handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	host = strings.TrimPrefix(server.URL, "https://")
+	dsts, _ = ResolveDestinations([]string{"https://" + host}, CandidateRole)
+	dsts.Configure(DestinationOptions{DstInsecure: true, DstHTTP2: true})
+
+	req, _ = http.NewRequest("GET", server.URL+"/", nil)
+	res, err := dsts[0].RoundTrip(req)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+		assert.Equal(t, res.ProtoMajor, 2)
+	}
+}
+
+func TestResolveDestinationsWithOptions(t *testing.T) {
+	dsts, err := ResolveDestinations([]string{"127.0.0.1:8080,rps=10,bps=1000"}, CandidateRole)
+	if assert.Nil(t, err) && assert.Len(t, dsts, 1) {
+		assert.Equal(t, dsts[0].String(), "127.0.0.1:8080")
+		assert.Equal(t, dsts[0].Requests.Rate, 10.0)
+		assert.Equal(t, dsts[0].Bytes.Rate, 1000.0)
+		assert.Equal(t, dsts[0].Breaker.Threshold, 0.0)
+	}
+
+	_, err = ResolveDestinations([]string{"127.0.0.1:8080,foo=1"}, CandidateRole)
+	assert.NotNil(t, err)
+
+	_, err = ResolveDestinations([]string{"127.0.0.1:8080,rps=-1"}, CandidateRole)
+	assert.NotNil(t, err)
+}
+
+func TestDestinationAllow(t *testing.T) {
+	dsts, _ := ResolveDestinations([]string{"127.0.0.1:8080,rps=2,bps=10"}, CandidateRole)
+	req, _ := http.NewRequest("POST", "/", nil)
+
+	assert.True(t, dsts[0].allow(req))
+	req.ContentLength = 25
+	assert.True(t, dsts[0].allow(req))
+	req.ContentLength = 1
+	assert.False(t, dsts[0].allow(req))
+}
+
+func TestDestinationAllowReturnsRequestTokens(t *testing.T) {
+	dsts, _ := ResolveDestinations([]string{"127.0.0.1:8080,rps=1,bps=10"}, CandidateRole)
+	req, _ := http.NewRequest("POST", "/", nil)
+
+	/* The request rejected for its size leaves the request token for the
+	   next one. */
+	dsts[0].Bytes.Take(10)
+	req.ContentLength = 5
+	assert.False(t, dsts[0].allow(req))
+	req.ContentLength = 0
+	assert.True(t, dsts[0].allow(req))
+}
+
+func TestResolveDestinationsWithQueueOptions(t *testing.T) {
+	dsts, err := ResolveDestinations([]string{"127.0.0.1:8080,workers=4,queue=10,drop=oldest"}, CandidateRole)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dsts[0].Queue.Workers, 4)
+		assert.Equal(t, dsts[0].Queue.Size, 10)
+		assert.True(t, dsts[0].Queue.DropOldest)
+	}
+
+	_, err = ResolveDestinations([]string{"127.0.0.1:8080,drop=random"}, CandidateRole)
+	assert.NotNil(t, err)
+}
+
+func TestDestinationSendRetriesFailedHandshakes(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	cert := server.TLS.Certificates[0]
+	server.Close()
+
+	listener, _ := net.Listen("tcp", "localhost:0")
+	defer listener.Close()
+
+	go func() {
+		/* The first connection fails before the TLS handshake completes. */
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+
+		if conn, err = listener.Accept(); err != nil {
+			return
+		}
+		conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		defer conn.Close()
+
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		}
+	}()
+
+	dsts, _ := ResolveDestinations([]string{"https://" + listener.Addr().String() + ",retries=1,backoff=1ms"}, CandidateRole)
+	dsts.Configure(DestinationOptions{DstInsecure: true})
+
+	body := NewBody([]byte("FOO"))
+	req, _ := http.NewRequest("POST", "https://"+listener.Addr().String()+"/", body.Reader())
+	res, err := dsts[0].Send(req, body)
+	if assert.Nil(t, err) {
+		assert.Equal(t, res.StatusCode, 204)
+	}
+}
+
+func TestDestinationSendDoesNotRetrySentRequests(t *testing.T) {
+	listener, _ := net.Listen("tcp", "localhost:0")
+
+	accepted := make(chan bool, 2)
+	go func() {
+		/* Connections fail after the request was sent, but before a response. */
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- true
+			http.ReadRequest(bufio.NewReader(conn))
+			conn.Close()
+		}
+	}()
+
+	dsts, _ := ResolveDestinations([]string{listener.Addr().String() + ",retries=1,backoff=1ms"}, CandidateRole)
+	dsts.Configure(DestinationOptions{})
+
+	body := NewBody([]byte("FOO"))
+	req, _ := http.NewRequest("POST", "http://"+listener.Addr().String()+"/", body.Reader())
+	_, err := dsts[0].Send(req, body)
+	assert.NotNil(t, err)
+
+	listener.Close()
+	n := 0
+	for range accepted {
+		n++
+	}
+	assert.Equal(t, n, 1)
+}
+
+func TestDestinationBackoff(t *testing.T) {
+	dsts, _ := ResolveDestinations([]string{"127.0.0.1:8080,backoff=1s"}, CandidateRole)
+
+	assert.Equal(t, dsts[0].backoff(0), time.Second)
+	assert.Equal(t, dsts[0].backoff(2), 4*time.Second)
+	assert.Equal(t, dsts[0].backoff(5), maxBackoff)
+	assert.Equal(t, dsts[0].backoff(100), maxBackoff)
+}
+
+func TestDestinationHeaderTimeout(t *testing.T) {
+	listener, _ := net.Listen("tcp", "localhost:0")
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dsts, _ := ResolveDestinations([]string{listener.Addr().String() + ",header-timeout=50ms"}, CandidateRole)
+	dsts.Configure(DestinationOptions{})
+	assert.Equal(t, dsts[0].HeaderTimeout, 50*time.Millisecond)
+
+	req, _ := http.NewRequest("GET", "http://"+listener.Addr().String()+"/", nil)
+	start := time.Now()
+	_, err := dsts[0].Send(req, nil)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second/2)
+
+	dsts.Configure(DestinationOptions{DstHTTP2: true})
+	start = time.Now()
+	_, err = dsts[0].Send(req, nil)
+	assert.Equal(t, err, errHeaderTimeout)
+	assert.True(t, time.Since(start) < time.Second/2)
+}
+
+func TestDestinationsRouteByWeight(t *testing.T) {
+	dsts, err := ResolveDestinations([]string{"127.0.0.1:8080,weight=1", "127.0.0.1:8081,weight=3", "127.0.0.1:8082"}, CandidateRole)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dsts.Route(0.2), DestinationList{dsts[0], dsts[2]})
+		assert.Equal(t, dsts.Route(0.3), DestinationList{dsts[1], dsts[2]})
+		assert.Equal(t, dsts.Route(0.99), DestinationList{dsts[1], dsts[2]})
+	}
+
+	_, err = ResolveDestinations([]string{"127.0.0.1:8080,weight=0"}, CandidateRole)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,237 @@
+package httap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Differ struct {
+	Headers []string
+	Ignore  [][]string
+}
+
+type Difference struct {
+	Field      string `json:"field"`
+	Production string `json:"production"`
+	Candidate  string `json:"candidate"`
+}
+
+type Mismatch struct {
+	Time        time.Time    `json:"time"`
+	Src         string       `json:"src"`
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	Destination string       `json:"destination"`
+	Differences []Difference `json:"differences"`
+}
+
+type Reporter struct {
+	*LogFile
+}
+
+type missing struct{}
+
+func NewDiffer(headers, ignore []string) *Differ {
+	differ := &Differ{}
+	for _, header := range headers {
+		differ.Headers = append(differ.Headers, http.CanonicalHeaderKey(header))
+	}
+	for _, path := range ignore {
+		differ.Ignore = append(differ.Ignore, strings.Split(path, "."))
+	}
+	return differ
+}
+
+func NewReporter(path string) (*Reporter, error) {
+	file, err := OpenLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reporter{file}, nil
+}
+
+func (rep *Reporter) Report(mismatch *Mismatch) error {
+	return rep.Write(mismatch)
+}
+
+func (d *Differ) Compare(prod, cand *Response) (diffs []Difference) {
+	if prod.StatusCode != cand.StatusCode {
+		diffs = append(diffs, Difference{
+			Field:      "status",
+			Production: strconv.Itoa(prod.StatusCode),
+			Candidate:  strconv.Itoa(cand.StatusCode),
+		})
+	}
+
+	for _, header := range d.Headers {
+		prodValue := strings.Join(prod.Header[header], ", ")
+		candValue := strings.Join(cand.Header[header], ", ")
+		if prodValue != candValue {
+			diffs = append(diffs, Difference{
+				Field:      "header." + header,
+				Production: prodValue,
+				Candidate:  candValue,
+			})
+		}
+	}
+
+	/* Truncated bodies cannot be compared reliably. */
+	if prod.Truncated || cand.Truncated {
+		return
+	}
+
+	prodBody, candBody := decodeBody(prod), decodeBody(cand)
+
+	var prodJSON, candJSON interface{}
+	if decodeJSON(prodBody, &prodJSON) && decodeJSON(candBody, &candJSON) {
+		d.compareJSON([]string{}, prodJSON, candJSON, &diffs)
+	} else if !bytes.Equal(prodBody, candBody) {
+		diffs = append(diffs, Difference{
+			Field:      "body",
+			Production: string(prodBody),
+			Candidate:  string(candBody),
+		})
+	}
+
+	return
+}
+
+func (d *Differ) CompareWithBaseline(prod, cand, base *Response) []Difference {
+	diffs := d.Compare(prod, cand)
+	if base == nil {
+		return diffs
+	}
+
+	/* Fields that differ between production and baseline are noise, since
+	   both run the same code. */
+	noise := make(map[string]bool)
+	for _, diff := range d.Compare(prod, base) {
+		noise[diff.Field] = true
+	}
+
+	var filtered []Difference
+	for _, diff := range diffs {
+		if !noise[diff.Field] {
+			filtered = append(filtered, diff)
+		}
+	}
+	return filtered
+}
+
+func (d *Differ) compareJSON(path []string, prod, cand interface{}, diffs *[]Difference) {
+	if d.ignored(path) {
+		return
+	}
+
+	switch prodValue := prod.(type) {
+	case map[string]interface{}:
+		if candValue, ok := cand.(map[string]interface{}); ok {
+			for _, key := range unionKeys(prodValue, candValue) {
+				d.compareJSON(append(path, key), lookupKey(prodValue, key), lookupKey(candValue, key), diffs)
+			}
+			return
+		}
+	case []interface{}:
+		if candValue, ok := cand.([]interface{}); ok {
+			for i := 0; i < len(prodValue) || i < len(candValue); i++ {
+				d.compareJSON(append(path, strconv.Itoa(i)), lookupIndex(prodValue, i), lookupIndex(candValue, i), diffs)
+			}
+			return
+		}
+	default:
+		if encodeJSON(prod) == encodeJSON(cand) {
+			return
+		}
+	}
+
+	*diffs = append(*diffs, Difference{
+		Field:      strings.Join(append([]string{"body"}, path...), "."),
+		Production: encodeJSON(prod),
+		Candidate:  encodeJSON(cand),
+	})
+}
+
+func (d *Differ) ignored(path []string) bool {
+Patterns:
+	for _, pattern := range d.Ignore {
+		if len(pattern) != len(path) {
+			continue
+		}
+
+		for i, segment := range pattern {
+			if segment != "*" && segment != path[i] {
+				continue Patterns
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func decodeBody(res *Response) []byte {
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		return res.Body
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(res.Body))
+	if err != nil {
+		return res.Body
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return res.Body
+	}
+	return body
+}
+
+func decodeJSON(data []byte, value *interface{}) bool {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	/* Keep numbers verbatim, large identifiers do not survive floats. */
+	decoder.UseNumber()
+	return len(bytes.TrimSpace(data)) > 0 && decoder.Decode(value) == nil
+}
+
+func encodeJSON(value interface{}) string {
+	if _, ok := value.(missing); ok {
+		return ""
+	}
+
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func unionKeys(a, b map[string]interface{}) (keys []string) {
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func lookupKey(values map[string]interface{}, key string) interface{} {
+	if value, ok := values[key]; ok {
+		return value
+	}
+	return missing{}
+}
+
+func lookupIndex(values []interface{}, i int) interface{} {
+	if i < len(values) {
+		return values[i]
+	}
+	return missing{}
+}
@@ -0,0 +1,100 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"bytes"
+	"compress/gzip"
+	"net/http"
+)
+
+func jsonResponse(status int, body string) *Response {
+	return &Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       []byte(body),
+	}
+}
+
+func TestDifferComparesStatus(t *testing.T) {
+	differ := NewDiffer(nil, nil)
+	diffs := differ.Compare(jsonResponse(200, `{}`), jsonResponse(500, `{}`))
+
+	assert.Equal(t, diffs, []Difference{{Field: "status", Production: "200", Candidate: "500"}})
+}
+
+func TestDifferComparesSelectedHeaders(t *testing.T) {
+	differ := NewDiffer([]string{"content-type"}, nil)
+	prod := jsonResponse(200, `{}`)
+	cand := jsonResponse(200, `{}`)
+	cand.Header.Set("Content-Type", "text/plain")
+	cand.Header.Set("Date", "Mon, 01 Sep 2014 12:00:00 GMT")
+
+	diffs := differ.Compare(prod, cand)
+	assert.Equal(t, diffs, []Difference{{Field: "header.Content-Type", Production: "application/json", Candidate: "text/plain"}})
+}
+
+func TestDifferComparesJsonStructurally(t *testing.T) {
+	differ := NewDiffer(nil, nil)
+	diffs := differ.Compare(
+		jsonResponse(200, `{"id": 12345678901234567890, "tags": ["a", "b"], "user": {"name": "foo"}}`),
+		jsonResponse(200, `{"user":{"name":"bar"},"tags":["a"],"id":12345678901234567890}`))
+
+	assert.Equal(t, diffs, []Difference{
+		{Field: "body.tags.1", Production: `"b"`, Candidate: ""},
+		{Field: "body.user.name", Production: `"foo"`, Candidate: `"bar"`},
+	})
+}
+
+func TestDifferIgnoresJsonPaths(t *testing.T) {
+	differ := NewDiffer(nil, []string{"timestamp", "items.*.request_id"})
+	diffs := differ.Compare(
+		jsonResponse(200, `{"timestamp": 1, "items": [{"request_id": "a", "value": 1}, {"request_id": "b"}]}`),
+		jsonResponse(200, `{"timestamp": 2, "items": [{"request_id": "c", "value": 2}, {"request_id": "d"}]}`))
+
+	assert.Equal(t, diffs, []Difference{{Field: "body.items.0.value", Production: "1", Candidate: "2"}})
+}
+
+func TestDifferComparesPlainBodies(t *testing.T) {
+	differ := NewDiffer(nil, nil)
+
+	diffs := differ.Compare(&Response{StatusCode: 200, Body: []byte("foo")}, &Response{StatusCode: 200, Body: []byte("foo")})
+	assert.Equal(t, len(diffs), 0)
+
+	diffs = differ.Compare(&Response{StatusCode: 200, Body: []byte("foo")}, &Response{StatusCode: 200, Body: []byte("bar")})
+	assert.Equal(t, diffs, []Difference{{Field: "body", Production: "foo", Candidate: "bar"}})
+}
+
+func TestDifferSkipsTruncatedBodies(t *testing.T) {
+	differ := NewDiffer(nil, nil)
+
+	diffs := differ.Compare(&Response{StatusCode: 200, Body: []byte("foo"), Truncated: true}, &Response{StatusCode: 200, Body: []byte("bar")})
+	assert.Equal(t, len(diffs), 0)
+}
+
+func TestDifferDecompressesBodies(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"foo": "bar"}`))
+	writer.Close()
+
+	prod := jsonResponse(200, `{"foo":"bar"}`)
+	cand := jsonResponse(200, compressed.String())
+	cand.Header.Set("Content-Encoding", "gzip")
+
+	assert.Equal(t, len(NewDiffer(nil, nil).Compare(prod, cand)), 0)
+}
+
+func TestDifferIgnoresBaselineNoise(t *testing.T) {
+	differ := NewDiffer(nil, nil)
+	diffs := differ.CompareWithBaseline(
+		jsonResponse(200, `{"now": 1, "token": "a", "total": 10}`),
+		jsonResponse(200, `{"now": 3, "token": "c", "total": 11}`),
+		jsonResponse(200, `{"now": 2, "token": "b", "total": 10}`))
+
+	assert.Equal(t, diffs, []Difference{{Field: "body.total", Production: "10", Candidate: "11"}})
+
+	diffs = differ.CompareWithBaseline(jsonResponse(200, `{"now": 1}`), jsonResponse(200, `{"now": 3}`), nil)
+	assert.Equal(t, diffs, []Difference{{Field: "body.now", Production: "1", Candidate: "3"}})
+}
@@ -0,0 +1,172 @@
+package httap
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const h2MaxStreams = 256
+
+type h2Request struct {
+	req  *http.Request
+	body *bodyWriter
+}
+
+func isH2CPreface(buf *bufio.Reader) bool {
+	b, err := buf.Peek(len(http2.ClientPreface))
+	return err == nil && string(b) == http2.ClientPreface
+}
+
+func isH2CUpgrade(req *http.Request) bool {
+	return strings.ToLower(req.Header.Get("Upgrade")) == "h2c"
+}
+
+func isGRPC(req *http.Request) bool {
+	/* Subtypes such as application/grpc+proto are gRPC as well, but
+	   application/grpc-web works over HTTP/1.1. */
+	contentType := req.Header.Get("Content-Type")
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+func isH2Frames(buf *bufio.Reader) bool {
+	/* Servers start every HTTP/2 connection with a SETTINGS frame. */
+	b, err := buf.Peek(9)
+	return err == nil && http2.FrameType(b[3]) == http2.FrameSettings && b[5]|b[6]|b[7]|b[8] == 0
+}
+
+func (st *Stream) consumeH2C(buf *bufio.Reader) {
+	if _, err := buf.Discard(len(http2.ClientPreface)); err != nil {
+		return
+	}
+
+	framer := http2.NewFramer(ioutil.Discard, buf)
+	framer.SetMaxReadFrameSize(1<<24 - 1)
+
+	/* The header table is shared by all streams of a connection, and is
+	   limited by settings sent by the server, which are not parsed here. */
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	framer.ReadMetaHeaders.SetAllowedMaxDynamicTableSize(1 << 24)
+
+	streams := make(map[uint32]*h2Request)
+	defer func() {
+		for _, s := range streams {
+			s.body.finish().release()
+		}
+	}()
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		} else if err != nil {
+			/* Frames cannot be resynchronized, stop parsing this connection. */
+			st.tap.Log("Error: %s", err)
+			tcpreader.DiscardBytesToEOF(buf)
+			return
+		}
+
+		id := frame.Header().StreamID
+
+		switch frame := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			/* Headers on a stream that has already started are trailers,
+			   which are not forwarded. */
+			if streams[id] == nil {
+				/* Streams that never end must not accumulate without limit. */
+				if len(streams) >= h2MaxStreams {
+					st.tap.Log("Error: too many concurrent HTTP/2 streams, ignoring stream %d", id)
+					atomic.AddInt64(&st.tap.Stats.LostRequests, 1)
+					continue
+				}
+
+				req, err := newH2Request(frame)
+				if err != nil {
+					st.tap.Log("Error: %s", err)
+					continue
+				}
+				streams[id] = &h2Request{req: req, body: newBodyWriter(st.tap.MaxBody, st.tap.BodyPolicy)}
+			}
+
+			if frame.StreamEnded() {
+				st.forwardH2(streams[id])
+				delete(streams, id)
+			}
+
+		case *http2.DataFrame:
+			s := streams[id]
+			if s == nil {
+				continue
+			}
+
+			s.body.Write(frame.Data())
+			if frame.StreamEnded() {
+				st.forwardH2(s)
+				delete(streams, id)
+			}
+
+		case *http2.RSTStreamFrame:
+			if s := streams[id]; s != nil {
+				s.body.finish().release()
+				delete(streams, id)
+			}
+
+		case *http2.GoAwayFrame:
+			tcpreader.DiscardBytesToEOF(buf)
+			return
+		}
+	}
+}
+
+func newH2Request(frame *http2.MetaHeadersFrame) (*http.Request, error) {
+	req := &http.Request{
+		Method:     frame.PseudoValue("method"),
+		Host:       frame.PseudoValue("authority"),
+		RequestURI: frame.PseudoValue("path"),
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+	}
+
+	for _, field := range frame.RegularFields() {
+		req.Header.Add(http.CanonicalHeaderKey(field.Name), field.Value)
+	}
+
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	req.Header.Del("Host")
+
+	var err error
+	if req.URL, err = url.ParseRequestURI(req.RequestURI); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (st *Stream) forwardH2(s *h2Request) {
+	body := s.body.finish()
+	if s.body.err != nil {
+		st.tap.Log("Error: %s", s.body.err)
+	}
+
+	if !st.accept(s.req) {
+		body.release()
+		return
+	}
+
+	/* The body was already read as frames arrived. HTTP/2 responses are not
+	   parsed, so these requests are not paired. */
+	s.req.ContentLength = body.Len()
+	st.forwardBody(s.req, nil, body, st.route(s.req))
+}
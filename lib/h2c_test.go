@@ -0,0 +1,170 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/google/gopacket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func writeH2Headers(framer *http2.Framer, id uint32, end bool, fields ...string) {
+	block := new(bytes.Buffer)
+	encoder := hpack.NewEncoder(block)
+	for i := 0; i < len(fields); i += 2 {
+		encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: block.Bytes(),
+		EndStream:     end,
+		EndHeaders:    true,
+	})
+}
+
+func TestConsumeH2CForwardsStreams(t *testing.T) {
+	host, reqs := createHttpChannel(2)
+	tap := NewWiretap(Options{Destinations: []string{host}})
+	tap.RepeatDelay = 0
+
+	data := new(bytes.Buffer)
+	io.WriteString(data, http2.ClientPreface)
+	framer := http2.NewFramer(data, nil)
+	framer.WriteSettings()
+	writeH2Headers(framer, 1, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/foo?bar=baz", "content-type", "text/plain")
+	writeH2Headers(framer, 3, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/bar")
+	framer.WriteData(1, true, []byte("FOO BAR BAZ"))
+
+	buf := bufio.NewReader(data)
+	assert.True(t, isH2CPreface(buf))
+	NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil).consumeH2C(buf)
+
+	/* Requests are sent concurrently, so they may arrive in any order. */
+	first, second := <-reqs, <-reqs
+	if first.Method != "GET" {
+		first, second = second, first
+	}
+
+	assert.Equal(t, first.Method, "GET")
+	assert.Equal(t, first.URL.String(), "/bar")
+	assert.Equal(t, first.Host, "example.com")
+
+	assert.Equal(t, second.Method, "POST")
+	assert.Equal(t, second.URL.String(), "/foo?bar=baz")
+	assert.Equal(t, second.Header.Get("Content-Type"), "text/plain")
+	assert.Equal(t, string(second.consumedBody), "FOO BAR BAZ")
+}
+
+func TestConsumeH2CLimitsStreams(t *testing.T) {
+	host, reqs := createHttpChannel(1)
+	tap := NewWiretap(Options{Destinations: []string{host}, MaxBody: 3, BodyPolicy: TruncateBody})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	data := new(bytes.Buffer)
+	io.WriteString(data, http2.ClientPreface)
+	framer := http2.NewFramer(data, nil)
+	framer.WriteSettings()
+
+	/* None of these streams ever end. */
+	for id := uint32(3); id < 2*h2MaxStreams+5; id += 2 {
+		writeH2Headers(framer, id, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/open")
+	}
+
+	framer.WriteRSTStream(3, http2.ErrCodeCancel)
+	writeH2Headers(framer, 1001, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/upload")
+	framer.WriteData(1001, false, []byte("FOO "))
+	framer.WriteData(1001, true, []byte("BAR BAZ"))
+
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+	st.consumeH2C(bufio.NewReader(data))
+
+	/* The last of the open streams exceeds the limit, stream 1001 fits after
+	   stream 3 is reset. */
+	req := <-reqs
+	assert.Equal(t, req.URL.Path, "/upload")
+	assert.Equal(t, string(req.consumedBody), "FOO")
+	assert.Equal(t, tap.Stats.LargeBodies, int64(1))
+	assert.Equal(t, tap.Stats.LostRequests, int64(1))
+	assert.Equal(t, tap.Stats.Requests, int64(1))
+}
+
+func TestIsGRPC(t *testing.T) {
+	for contentType, grpc := range map[string]bool{
+		"application/grpc":            true,
+		"application/grpc+proto":      true,
+		"application/grpc; charset=x": true,
+		"application/grpc-web":        false,
+		"application/grpc-web-text":   false,
+		"application/json":            false,
+	} {
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.Header.Set("Content-Type", contentType)
+		assert.Equal(t, isGRPC(req), grpc, contentType)
+	}
+}
+
+func TestIsH2Frames(t *testing.T) {
+	data := new(bytes.Buffer)
+	http2.NewFramer(data, nil).WriteSettings()
+
+	assert.True(t, isH2Frames(bufio.NewReader(data)))
+	assert.False(t, isH2Frames(bufio.NewReader(bytes.NewBufferString("HTTP/1.1 200 OK\r\n\r\n"))))
+}
+
+func createH2CChannel() (net.Listener, chan requestInfo) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(err)
+	}
+
+	channel := make(chan requestInfo, 2)
+	handler := func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		channel <- requestInfo{req, body}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go new(http2.Server).ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(handler)})
+		}
+	}()
+
+	return listener, channel
+}
+
+func TestForwardGRPCOverH2C(t *testing.T) {
+	listener, reqs := createH2CChannel()
+	defer listener.Close()
+
+	tap := NewWiretap(Options{Destinations: []string{listener.Addr().String()}, GRPCMethods: []string{"/pkg.Service/Allowed"}})
+	tap.RepeatDelay = 0
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+
+	for _, path := range []string{"/pkg.Service/Filtered", "/pkg.Service/Allowed"} {
+		req, _ := http.NewRequest("POST", path, strings.NewReader("\x00\x00\x00\x00\x00"))
+		req.Host = "example.com"
+		req.Header.Set("Content-Type", "application/grpc")
+		st.forward(req, nil)
+	}
+
+	req := <-reqs
+	assert.Equal(t, req.ProtoMajor, 2)
+	assert.Equal(t, req.URL.Path, "/pkg.Service/Allowed")
+	assert.Equal(t, req.Host, "example.com")
+	assert.Equal(t, req.consumedBody, []byte("\x00\x00\x00\x00\x00"))
+}
@@ -0,0 +1,52 @@
+package httap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+type Key struct {
+	Kind string
+	Name string
+}
+
+func ParseKey(spec string) (*Key, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	switch {
+	case len(parts) == 1 && parts[0] == "ip":
+		return &Key{Kind: "ip"}, nil
+	case len(parts) == 2 && (parts[0] == "header" || parts[0] == "cookie") && parts[1] != "":
+		return &Key{Kind: parts[0], Name: parts[1]}, nil
+	}
+	return nil, fmt.Errorf("invalid key %q, use ip, header:NAME or cookie:NAME", spec)
+}
+
+func (k *Key) Value(req *http.Request, src string) string {
+	switch k.Kind {
+	case "ip":
+		return src
+	case "header":
+		return req.Header.Get(k.Name)
+	case "cookie":
+		if cookie, err := req.Cookie(k.Name); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func hashKey(salt, value string) float64 {
+	/* Maps keys uniformly to [0, 1). Different salts keep routing and
+	   sampling decisions independent of each other. */
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
@@ -0,0 +1,45 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"net/http"
+)
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("header:X-Session")
+	if assert.Nil(t, err) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Session", "abc")
+		assert.Equal(t, key.Value(req, "10.0.0.1:1234"), "abc")
+	}
+
+	key, err = ParseKey("ip")
+	if assert.Nil(t, err) {
+		assert.Equal(t, key.Value(nil, "10.0.0.1"), "10.0.0.1")
+	}
+
+	key, err = ParseKey("cookie:session")
+	if assert.Nil(t, err) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", "theme=dark; session=xyz")
+		assert.Equal(t, key.Value(req, ""), "xyz")
+	}
+
+	key, err = ParseKey("")
+	assert.Nil(t, key)
+	assert.Nil(t, err)
+
+	_, err = ParseKey("header:")
+	assert.NotNil(t, err)
+	_, err = ParseKey("body")
+	assert.NotNil(t, err)
+}
+
+func TestHashKey(t *testing.T) {
+	assert.Equal(t, hashKey("route", "abc"), hashKey("route", "abc"))
+	assert.NotEqual(t, hashKey("route", "abc"), hashKey("route", "abd"))
+	assert.NotEqual(t, hashKey("route", "abc"), hashKey("sample", "abc"))
+	assert.True(t, hashKey("route", "abc") >= 0 && hashKey("route", "abc") < 1)
+}
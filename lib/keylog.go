@@ -0,0 +1,92 @@
+package httap
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type KeyLog struct {
+	Path    string
+	secrets map[string][]byte
+	offset  int64
+	mutex   sync.Mutex
+}
+
+func LoadKeyLog(path string) (*KeyLog, error) {
+	kl := &KeyLog{Path: path, secrets: make(map[string][]byte)}
+	if err := kl.reload(); err != nil {
+		return nil, err
+	}
+	return kl, nil
+}
+
+func (kl *KeyLog) Lookup(label string, clientRandom []byte) []byte {
+	kl.mutex.Lock()
+	defer kl.mutex.Unlock()
+
+	key := label + " " + hex.EncodeToString(clientRandom)
+	if secret, ok := kl.secrets[key]; ok {
+		return secret
+	}
+
+	/* Applications append to the key log as sessions are established, so
+	   secrets for new sessions may have been written since the last read. */
+	if kl.Path != "" {
+		kl.reload()
+	}
+	return kl.secrets[key]
+}
+
+func (kl *KeyLog) reload() error {
+	file, err := os.Open(kl.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(kl.offset, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	n, err := kl.load(file)
+	kl.offset += n
+	return err
+}
+
+func (kl *KeyLog) load(reader io.Reader) (int64, error) {
+	var n int64
+	buf := bufio.NewReader(reader)
+
+	for {
+		line, err := buf.ReadString('\n')
+		if err == io.EOF {
+			/* Leave incomplete lines for the next read. */
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n += int64(len(line))
+
+		/* Lines are formatted as "LABEL <client random> <secret>" in hex. */
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		random, err := hex.DecodeString(fields[1])
+		if err != nil {
+			continue
+		}
+
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+
+		kl.secrets[fields[0]+" "+hex.EncodeToString(random)] = secret
+	}
+}
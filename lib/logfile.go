@@ -0,0 +1,43 @@
+package httap
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+type LogFile struct {
+	Path    string
+	file    *os.File
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogFile{
+		Path:    path,
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (lf *LogFile) Write(entry interface{}) error {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+
+	/* Each entry is written with a single unbuffered write, so the log
+	   only ever loses the entry that was being written on a crash. */
+	return lf.encoder.Encode(entry)
+}
+
+func (lf *LogFile) Close() error {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+
+	return lf.file.Close()
+}
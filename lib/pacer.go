@@ -0,0 +1,44 @@
+package httap
+
+import (
+	"time"
+)
+
+type Pacer struct {
+	Speed float64
+	Rate  float64
+	first time.Time
+	start time.Time
+	next  time.Time
+}
+
+func (p *Pacer) Wait(timestamp time.Time) {
+	if p.Speed > 0 {
+		p.waitTimestamp(timestamp)
+	}
+
+	if p.Rate > 0 {
+		p.waitRate()
+	}
+}
+
+func (p *Pacer) waitTimestamp(timestamp time.Time) {
+	if p.first.IsZero() {
+		p.first = timestamp
+		p.start = time.Now()
+		return
+	}
+
+	/* Space events like their original timestamps, scaled by speed. */
+	offset := time.Duration(float64(timestamp.Sub(p.first)) / p.Speed)
+	if delay := p.start.Add(offset).Sub(time.Now()); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (p *Pacer) waitRate() {
+	if delay := p.next.Sub(time.Now()); delay > 0 {
+		time.Sleep(delay)
+	}
+	p.next = time.Now().Add(time.Duration(float64(time.Second) / p.Rate))
+}
@@ -0,0 +1,54 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"time"
+)
+
+func TestPacerFollowsTimestamps(t *testing.T) {
+	pacer := &Pacer{Speed: 1}
+	origin := time.Unix(1400000000, 0)
+
+	start := time.Now()
+	pacer.Wait(origin)
+	pacer.Wait(origin.Add(50 * time.Millisecond))
+
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestPacerAppliesSpeed(t *testing.T) {
+	pacer := &Pacer{Speed: 10}
+	origin := time.Unix(1400000000, 0)
+
+	start := time.Now()
+	pacer.Wait(origin)
+	pacer.Wait(origin.Add(500 * time.Millisecond))
+
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestPacerWithoutSpeedDoesNotWait(t *testing.T) {
+	pacer := &Pacer{}
+	origin := time.Unix(1400000000, 0)
+
+	start := time.Now()
+	pacer.Wait(origin)
+	pacer.Wait(origin.Add(time.Hour))
+
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestPacerLimitsRate(t *testing.T) {
+	pacer := &Pacer{Rate: 100}
+	origin := time.Unix(1400000000, 0)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		pacer.Wait(origin)
+	}
+
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
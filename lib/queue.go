@@ -0,0 +1,80 @@
+package httap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type Queue struct {
+	busy       int32
+	Workers    int
+	Size       int
+	DropOldest bool
+	Block      bool
+	jobs       chan *job
+	start      sync.Once
+}
+
+type job struct {
+	run  func()
+	drop func()
+}
+
+func NewQueue(workers, size int, dropOldest bool) *Queue {
+	return &Queue{
+		Workers:    workers,
+		Size:       size,
+		DropOldest: dropOldest,
+		jobs:       make(chan *job, size),
+	}
+}
+
+func (q *Queue) Push(run, drop func()) {
+	q.start.Do(func() {
+		for i := 0; i < q.Workers; i++ {
+			go q.work()
+		}
+	})
+
+	j := &job{run, drop}
+	if q.Block {
+		q.jobs <- j
+		return
+	}
+
+	for {
+		select {
+		case q.jobs <- j:
+			return
+		default:
+		}
+
+		if !q.DropOldest {
+			j.drop()
+			return
+		}
+
+		/* Make room by dropping the job that has waited longest. */
+		select {
+		case old := <-q.jobs:
+			old.drop()
+		default:
+		}
+	}
+}
+
+func (q *Queue) Depth() int {
+	return len(q.jobs)
+}
+
+func (q *Queue) Idle() bool {
+	return len(q.jobs) == 0 && int(atomic.LoadInt32(&q.busy)) < q.Workers
+}
+
+func (q *Queue) work() {
+	for j := range q.jobs {
+		atomic.AddInt32(&q.busy, 1)
+		j.run()
+		atomic.AddInt32(&q.busy, -1)
+	}
+}
@@ -0,0 +1,46 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func fillQueue(q *Queue, n int) (chan bool, chan int, chan int) {
+	started, block := make(chan bool), make(chan bool)
+	ran, dropped := make(chan int, n), make(chan int, n)
+
+	/* The first job occupies the only worker until it is unblocked. */
+	q.Push(func() { started <- true; <-block }, func() {})
+	<-started
+
+	for i := 0; i < n; i++ {
+		i := i
+		q.Push(func() { ran <- i }, func() { dropped <- i })
+	}
+	return block, ran, dropped
+}
+
+func TestQueueDropsNewest(t *testing.T) {
+	q := NewQueue(1, 2, false)
+	block, ran, dropped := fillQueue(q, 3)
+
+	assert.Equal(t, q.Depth(), 2)
+	assert.False(t, q.Idle())
+	assert.Equal(t, <-dropped, 2)
+
+	close(block)
+	assert.Equal(t, <-ran, 0)
+	assert.Equal(t, <-ran, 1)
+}
+
+func TestQueueDropsOldest(t *testing.T) {
+	q := NewQueue(1, 2, true)
+	block, ran, dropped := fillQueue(q, 3)
+
+	assert.Equal(t, q.Depth(), 2)
+	assert.Equal(t, <-dropped, 0)
+
+	close(block)
+	assert.Equal(t, <-ran, 1)
+	assert.Equal(t, <-ran, 2)
+}
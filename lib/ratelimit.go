@@ -0,0 +1,61 @@
+package httap
+
+import (
+	"sync"
+	"time"
+)
+
+type TokenBucket struct {
+	Rate   float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	return &TokenBucket{Rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (b *TokenBucket) Take(n float64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+
+	/* Anything larger than the bucket may pass when it is full, and leaves
+	   it in debt. */
+	if b.tokens < n && b.tokens < b.Rate {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func (b *TokenBucket) Return(n float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens += n
+	if b.tokens > b.Rate {
+		b.tokens = b.Rate
+	}
+}
+
+func (b *TokenBucket) Charge(n float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+
+	/* Amounts only known afterwards are taken regardless, and leave the
+	   bucket in debt. */
+	b.tokens -= n
+}
+
+func (b *TokenBucket) refill() {
+	/* The bucket holds at most one second worth of tokens. */
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if b.tokens > b.Rate {
+		b.tokens = b.Rate
+	}
+	b.last = now
+}
@@ -0,0 +1,47 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"time"
+)
+
+func TestTokenBucketLimitsRate(t *testing.T) {
+	bucket := NewTokenBucket(2)
+
+	assert.True(t, bucket.Take(1))
+	assert.True(t, bucket.Take(1))
+	assert.False(t, bucket.Take(1))
+
+	bucket.last = bucket.last.Add(-time.Second / 2)
+	assert.True(t, bucket.Take(1))
+	assert.False(t, bucket.Take(1))
+}
+
+func TestTokenBucketAllowsLargeAmountsWhenFull(t *testing.T) {
+	bucket := NewTokenBucket(10)
+
+	assert.True(t, bucket.Take(25))
+	bucket.last = bucket.last.Add(-time.Second)
+	assert.False(t, bucket.Take(1))
+}
+
+func TestTokenBucketReturnsTokens(t *testing.T) {
+	bucket := NewTokenBucket(2)
+
+	assert.True(t, bucket.Take(2))
+	bucket.Return(1)
+	assert.True(t, bucket.Take(1))
+	assert.False(t, bucket.Take(1))
+}
+
+func TestTokenBucketChargesIntoDebt(t *testing.T) {
+	bucket := NewTokenBucket(10)
+
+	bucket.Charge(25)
+	bucket.last = bucket.last.Add(-time.Second)
+	assert.False(t, bucket.Take(1))
+	bucket.last = bucket.last.Add(-time.Second)
+	assert.True(t, bucket.Take(1))
+}
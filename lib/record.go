@@ -0,0 +1,125 @@
+package httap
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type Record struct {
+	Time   time.Time   `json:"time"`
+	Src    string      `json:"src"`
+	Dst    string      `json:"dst"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+type RecordReader struct {
+	decoder *json.Decoder
+}
+
+type Recorder struct {
+	*LogFile
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := OpenLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file}, nil
+}
+
+func (rec *Recorder) Record(record *Record) error {
+	return rec.Write(record)
+}
+
+func NewRecordReader(reader io.Reader) *RecordReader {
+	return &RecordReader{json.NewDecoder(reader)}
+}
+
+func (rr *RecordReader) Next() (*Record, error) {
+	record := new(Record)
+	if err := rr.decoder.Decode(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (record *Record) Request() (*http.Request, error) {
+	url, err := url.ParseRequestURI(record.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	header := record.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Request{
+		Method:        record.Method,
+		URL:           url,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(record.Body)),
+		ContentLength: int64(len(record.Body)),
+		Host:          record.Host,
+		RequestURI:    record.URL,
+	}, nil
+}
+
+func (record *Record) Flows() (netFlow, tcpFlow gopacket.Flow, err error) {
+	srcIP, srcPort, err := splitEndpoint(record.Src)
+	if err != nil {
+		return
+	}
+
+	dstIP, dstPort, err := splitEndpoint(record.Dst)
+	if err != nil {
+		return
+	}
+
+	if netFlow, err = gopacket.FlowFromEndpoints(srcIP, dstIP); err != nil {
+		return
+	}
+
+	tcpFlow, err = gopacket.FlowFromEndpoints(srcPort, dstPort)
+	return
+}
+
+func splitEndpoint(addr string) (ip, port gopacket.Endpoint, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	parsed := net.ParseIP(host)
+	if parsed == nil {
+		err = &net.ParseError{Type: "IP address", Text: host}
+		return
+	}
+
+	num, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return
+	}
+
+	return layers.NewIPEndpoint(parsed), layers.NewTCPPortEndpoint(layers.TCPPort(num)), nil
+}
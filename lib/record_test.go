@@ -0,0 +1,89 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func TestRecorderAppendsRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httap")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests.log")
+	rec, err := NewRecorder(path)
+	assert.Nil(t, err)
+
+	timestamp := time.Date(2014, 9, 1, 12, 0, 0, 0, time.UTC)
+	rec.Record(&Record{
+		Time:   timestamp,
+		Src:    "10.0.0.1:51234",
+		Dst:    "10.0.0.2:80",
+		Method: "POST",
+		URL:    "/foo?bar=baz",
+		Host:   "example.com",
+		Header: http.Header{"Content-Type": []string{"text/plain"}},
+		Body:   []byte("FOO BAR BAZ"),
+	})
+	rec.Record(&Record{Time: timestamp, Method: "GET", URL: "/"})
+	rec.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, len(lines), 2)
+
+	var record Record
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, record.Time, timestamp)
+	assert.Equal(t, record.Src, "10.0.0.1:51234")
+	assert.Equal(t, record.Method, "POST")
+	assert.Equal(t, record.URL, "/foo?bar=baz")
+	assert.Equal(t, record.Header.Get("Content-Type"), "text/plain")
+	assert.Equal(t, string(record.Body), "FOO BAR BAZ")
+}
+
+func TestRecordReaderRestoresRequests(t *testing.T) {
+	log := `{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"POST","url":"/foo?bar=baz","host":"example.com","header":{"Content-Type":["text/plain"]},"body":"Rk9PIEJBUiBCQVo="}
+{"time":"2014-09-01T12:00:01Z","src":"[::1]:51235","dst":"[::1]:8080","method":"GET","url":"/","host":"example.com"}
+`
+	records := NewRecordReader(strings.NewReader(log))
+
+	record, err := records.Next()
+	assert.Nil(t, err)
+
+	req, err := record.Request()
+	assert.Nil(t, err)
+	assert.Equal(t, req.Method, "POST")
+	assert.Equal(t, req.URL.Path, "/foo")
+	assert.Equal(t, req.URL.RawQuery, "bar=baz")
+	assert.Equal(t, req.Host, "example.com")
+	assert.Equal(t, req.Header.Get("Content-Type"), "text/plain")
+	assert.Equal(t, req.ContentLength, int64(11))
+
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, string(body), "FOO BAR BAZ")
+
+	netFlow, tcpFlow, err := record.Flows()
+	assert.Nil(t, err)
+	assert.Equal(t, netFlow.Src().String(), "10.0.0.1")
+	assert.Equal(t, netFlow.Dst().String(), "10.0.0.2")
+	assert.Equal(t, tcpFlow.Dst().String(), "80")
+
+	record, err = records.Next()
+	assert.Nil(t, err)
+
+	netFlow, _, err = record.Flows()
+	assert.Nil(t, err)
+	assert.Equal(t, netFlow.Dst().String(), "::1")
+
+	_, err = records.Next()
+	assert.Equal(t, err, io.EOF)
+}
@@ -0,0 +1,117 @@
+package httap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+type Replay struct {
+	File  string
+	Speed float64
+	Rate  float64
+	Loop  int
+	tap   *Wiretap
+}
+
+type ReplayOptions struct {
+	Destinations   []string `short:"d" long:"dst"      description:"Destination(s) to forward recorded HTTP traffic to, optionally followed by destination options." value-name:"[https://]HOST[:PORT][,OPTION=VALUE]" required:"true"`
+	Headers        []string `short:"H" long:"header"   description:"Set or replace request header in duplicated traffic." value-name:"LINE"`
+	Methods        []string `short:"m" long:"method"   description:"Only forward requests with specific HTTP methods." value-name:"VERB"`
+	GRPCMethods    []string `long:"grpc-method"        description:"Only forward gRPC calls to specific methods." value-name:"/PKG.SERVICE/METHOD"`
+	Multiply       float32  `short:"n" long:"multiply" description:"Increase or reduce the number of requests by a factor." value-name:"N"`
+	SampleKey      string   `long:"sample-key"         description:"Mirror either all or none of the requests with the same client IP, header or cookie value when multiplying." value-name:"ip|header:NAME|cookie:NAME"`
+	Sticky         string   `long:"sticky"             description:"Route requests with the same client IP, header or cookie value to the same weighted destination." value-name:"ip|header:NAME|cookie:NAME"`
+	Speed          float64  `long:"speed"              description:"Replay at a factor of the recorded speed, 0 is as fast as possible." value-name:"N" default:"1"`
+	Rate           float64  `long:"rate"               description:"Replay at most N requests per second." value-name:"N"`
+	Loop           int      `long:"loop"               description:"Replay the request log N times, 0 loops forever." value-name:"N" default:"1"`
+	Verbose        bool     `short:"v" long:"verbose"  description:"Show extra information, including all request headers."`
+	DropIncomplete bool     `long:"drop-incomplete"    description:"Do not forward requests recorded with data missing."`
+	DestinationOptions
+}
+
+func NewReplay(file string, opts ReplayOptions) *Replay {
+	tap := NewWiretap(Options{
+		Destinations: opts.Destinations,
+		Headers:      opts.Headers,
+		Methods:      opts.Methods,
+		GRPCMethods:  opts.GRPCMethods,
+		Multiply:     opts.Multiply,
+		SampleKey:    opts.SampleKey,
+		Sticky:       opts.Sticky,
+		Verbose:      opts.Verbose,
+
+		DropIncomplete: opts.DropIncomplete,
+
+		DestinationOptions: opts.DestinationOptions,
+	})
+
+	/* Recorded requests can wait for a worker instead of being dropped. */
+	for _, dst := range tap.Destinations {
+		dst.Queue.Block = true
+	}
+
+	return &Replay{
+		File:  file,
+		Speed: opts.Speed,
+		Rate:  opts.Rate,
+		Loop:  opts.Loop,
+		tap:   tap,
+	}
+}
+
+func (rep *Replay) Start() {
+	fmt.Fprintf(os.Stderr, "Replaying HTTP traffic from %s and forwarding to %s...\n", rep.File, rep.tap.Destinations)
+
+	for n := 0; rep.Loop <= 0 || n < rep.Loop; n++ {
+		rep.replay()
+	}
+
+	rep.tap.pending.Wait()
+	fmt.Fprintf(os.Stderr, "Finished replaying %s\n", rep.File)
+}
+
+func (rep *Replay) replay() {
+	file, err := os.Open(rep.File)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	records := NewRecordReader(file)
+	pacer := &Pacer{Speed: rep.Speed, Rate: rep.Rate}
+
+	for {
+		record, err := records.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		pacer.Wait(record.Time)
+		rep.forward(record)
+	}
+}
+
+func (rep *Replay) forward(record *Record) {
+	req, err := record.Request()
+	if err != nil {
+		rep.tap.Log("Error: %s", err)
+		return
+	}
+
+	netFlow, tcpFlow, err := record.Flows()
+	if err != nil {
+		rep.tap.Log("Error: %s", err)
+		return
+	}
+
+	/* Recorded requests take the same path as live traffic. */
+	st := &Stream{tap: rep.tap, flow: netFlow, ports: tcpFlow, seen: record.Time, incomplete: record.Incomplete}
+	if st.incomplete {
+		atomic.AddInt64(&rep.tap.Stats.IncompleteRequests, 1)
+	}
+	st.forward(req, nil)
+}
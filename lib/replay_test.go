@@ -0,0 +1,168 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func writeRecordFile(dir string, lines ...string) string {
+	path := filepath.Join(dir, "requests.log")
+	data := new(bytes.Buffer)
+	for _, line := range lines {
+		data.WriteString(line + "\n")
+	}
+	ioutil.WriteFile(path, data.Bytes(), 0644)
+	return path
+}
+
+func TestReplayForwardsRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httap")
+	defer os.RemoveAll(dir)
+
+	path := writeRecordFile(dir,
+		`{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"POST","url":"/foo?bar=baz","host":"example.com","header":{"Content-Type":["text/plain"]},"body":"Rk9PIEJBUiBCQVo="}`,
+		`{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"GET","url":"/bar","host":"example.com"}`,
+		`{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"GET","url":"/baz","host":"example.com"}`,
+	)
+
+	/* A single worker with a single queue slot would drop requests if the
+	   queue did not block during replay. */
+	host, reqs := createHttpChannel(3)
+	rep := NewReplay(path, ReplayOptions{Destinations: []string{host + ",workers=1,queue=1"}, Loop: 1})
+	rep.tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	done := make(chan bool)
+	go func() {
+		rep.Start()
+		close(done)
+	}()
+
+	first := <-reqs
+	assert.Equal(t, first.Method, "POST")
+	assert.Equal(t, first.URL.String(), "/foo?bar=baz")
+	assert.Equal(t, first.Host, "example.com")
+	assert.Equal(t, string(first.consumedBody), "FOO BAR BAZ")
+
+	assert.Equal(t, (<-reqs).URL.Path, "/bar")
+	assert.Equal(t, (<-reqs).URL.Path, "/baz")
+
+	<-done
+	assert.Equal(t, rep.tap.Stats.Dropped, int64(0))
+}
+
+func TestReplayLoopsOverRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httap")
+	defer os.RemoveAll(dir)
+
+	path := writeRecordFile(dir,
+		`{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"GET","url":"/foo","host":"example.com"}`,
+	)
+
+	host, reqs := createHttpChannel(2)
+	rep := NewReplay(path, ReplayOptions{Destinations: []string{host}, Loop: 2})
+	rep.tap.Logger = log.New(new(bytes.Buffer), "", 0)
+	go rep.Start()
+
+	assert.Equal(t, (<-reqs).URL.Path, "/foo")
+	assert.Equal(t, (<-reqs).URL.Path, "/foo")
+}
+
+func TestReplayDropsIncompleteRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httap")
+	defer os.RemoveAll(dir)
+
+	path := writeRecordFile(dir,
+		`{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"POST","url":"/foo","host":"example.com","body":"Rk9P","incomplete":true}`,
+		`{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"GET","url":"/bar","host":"example.com"}`,
+	)
+
+	logs := new(bytes.Buffer)
+	host, reqs := createHttpChannel(1)
+	rep := NewReplay(path, ReplayOptions{Destinations: []string{host}, Loop: 1, DropIncomplete: true})
+	rep.tap.Logger = log.New(logs, "", 0)
+
+	done := make(chan bool)
+	go func() {
+		rep.Start()
+		close(done)
+	}()
+
+	assert.Equal(t, (<-reqs).URL.Path, "/bar")
+	<-done
+	assert.Contains(t, logs.String(), "POST http://example.com/foo (INCOMPLETE)")
+	assert.Equal(t, rep.tap.Stats.IncompleteRequests, int64(1))
+}
+
+func TestReplayMarksIncompleteRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httap")
+	defer os.RemoveAll(dir)
+
+	path := writeRecordFile(dir,
+		`{"time":"2014-09-01T12:00:00Z","src":"10.0.0.1:51234","dst":"10.0.0.2:80","method":"POST","url":"/foo","host":"example.com","body":"Rk9P","incomplete":true}`,
+	)
+
+	logs := new(bytes.Buffer)
+	host, reqs := createHttpChannel(1)
+	rep := NewReplay(path, ReplayOptions{Destinations: []string{host}, Loop: 1})
+	rep.tap.Logger = log.New(logs, "", 0)
+
+	done := make(chan bool)
+	go func() {
+		rep.Start()
+		close(done)
+	}()
+
+	assert.Equal(t, string((<-reqs).consumedBody), "FOO")
+	<-done
+	assert.Contains(t, logs.String(), "(incomplete)")
+	assert.Equal(t, rep.tap.Stats.IncompleteRequests, int64(1))
+}
+
+func TestReplayDropsTruncatedRecordings(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httap")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests.log")
+	tap := NewWiretap(Options{Record: path, MaxBody: 3})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	large, _ := http.NewRequest("POST", "/upload", strings.NewReader("FOO BAR BAZ"))
+	small, _ := http.NewRequest("POST", "/small", strings.NewReader("FOO"))
+	large.RequestURI, small.RequestURI = "/upload", "/small"
+	netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(10, 0, 0, 1)), layers.NewIPEndpoint(net.IPv4(10, 0, 0, 2)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(51234), layers.NewTCPPortEndpoint(80))
+	st := NewStream(tap, netFlow, tcpFlow, nil)
+	st.seen = time.Now()
+	st.forward(large, nil)
+	st.forward(small, nil)
+	tap.Recorder.Close()
+
+	/* The recorded body of the large request is cut short, replaying it
+	   would send a different request than the one captured. */
+	host, reqs := createHttpChannel(1)
+	rep := NewReplay(path, ReplayOptions{Destinations: []string{host}, Loop: 1, DropIncomplete: true})
+	rep.tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	done := make(chan bool)
+	go func() {
+		rep.Start()
+		close(done)
+	}()
+
+	assert.Equal(t, (<-reqs).URL.Path, "/small")
+	<-done
+	assert.Equal(t, rep.tap.Stats.IncompleteRequests, int64(1))
+}
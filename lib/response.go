@@ -0,0 +1,115 @@
+package httap
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+type ResponseStream struct {
+	tcpreader.ReaderStream
+	tap  *Wiretap
+	flow gopacket.Flow
+	conn *Conn
+}
+
+func NewResponseStream(tap *Wiretap, netFlow gopacket.Flow, conn *Conn) *ResponseStream {
+	return &ResponseStream{
+		ReaderStream: tcpreader.NewReaderStream(),
+		tap:          tap,
+		flow:         netFlow,
+		conn:         conn,
+	}
+}
+
+func (rs *ResponseStream) Consume() {
+	defer rs.conn.close()
+
+	buf := bufio.NewReader(rs)
+	if rs.tap.KeyLog != nil && isTLS(buf) {
+		buf = bufio.NewReader(newTLSReader(buf, rs.conn.tlsSession(rs.tap.KeyLog), false))
+	}
+
+	if isH2Frames(buf) {
+		/* HTTP/2 responses are not parsed. */
+		tcpreader.DiscardBytesToEOF(buf)
+		return
+	}
+
+	for {
+		/* Wait for the response to arrive before pairing it, so that the
+		   request it belongs to has been parsed. */
+		if _, err := buf.Peek(1); err != nil {
+			return
+		}
+
+		ex := rs.conn.next()
+
+		var req *http.Request
+		if ex != nil {
+			req = ex.Request
+		}
+
+		res, err := rs.read(buf, req)
+		if ex != nil {
+			ex.complete(res)
+		}
+
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			rs.tap.Log("Error: %s", err)
+		}
+
+		if res != nil && isTunnelResponse(req, res.StatusCode) {
+			/* The remainder of the connection no longer carries HTTP. */
+			tcpreader.DiscardBytesToEOF(buf)
+			return
+		}
+	}
+}
+
+func (rs *ResponseStream) read(buf *bufio.Reader, req *http.Request) (*Response, error) {
+	for {
+		res, err := http.ReadResponse(buf, req)
+		if err != nil {
+			return nil, err
+		}
+
+		/* Bodies are only kept when they are compared. */
+		response := &Response{StatusCode: res.StatusCode, Header: res.Header}
+		if rs.tap.Differ != nil {
+			response.Body, response.Truncated, err = readResponseBody(res.Body, rs.tap.MaxBody)
+		} else {
+			_, err = io.Copy(ioutil.Discard, res.Body)
+		}
+		res.Body.Close()
+
+		/* Informational responses precede the actual response. */
+		if res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+
+		return response, err
+	}
+}
+
+func readResponseBody(reader io.Reader, max int64) ([]byte, bool, error) {
+	if max <= 0 {
+		body, err := ioutil.ReadAll(reader)
+		return body, false, err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, max+1))
+	if err != nil || int64(len(body)) <= max {
+		return body, false, err
+	}
+
+	/* Consume the remainder, the stream continues after the body. */
+	_, err = io.Copy(ioutil.Discard, reader)
+	return body[:max], true, err
+}
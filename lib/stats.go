@@ -0,0 +1,30 @@
+package httap
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+type Stats struct {
+	Requests     int64
+	Tunnels      int64
+	LostRequests int64
+	SkippedBytes int64
+	BytesLost    int64
+
+	IncompleteRequests int64
+	LargeBodies        int64
+	Dropped            int64
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("%d requests, %d incomplete, %d large bodies, %d dropped, %d tunnels, %d lost requests, %d bytes skipped, %d bytes lost",
+		atomic.LoadInt64(&s.Requests),
+		atomic.LoadInt64(&s.IncompleteRequests),
+		atomic.LoadInt64(&s.LargeBodies),
+		atomic.LoadInt64(&s.Dropped),
+		atomic.LoadInt64(&s.Tunnels),
+		atomic.LoadInt64(&s.LostRequests),
+		atomic.LoadInt64(&s.SkippedBytes),
+		atomic.LoadInt64(&s.BytesLost))
+}
@@ -3,34 +3,96 @@ package httap
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
 	"github.com/google/gopacket/tcpassembly/tcpreader"
 )
 
+var requestLine = regexp.MustCompile(`^[A-Z]+ [^ \r\n]+ HTTP/1\.[01]\r?\n$`)
+
+type mirror struct {
+	dst        *Destination
+	req        *http.Request
+	url        string
+	repeat     bool
+	production *Exchange
+	baseline   *Exchange
+	incomplete bool
+	truncated  bool
+	body       *Body
+}
+
 type Stream struct {
 	tcpreader.ReaderStream
-	tap  *Wiretap
-	flow gopacket.Flow
+	tap   *Wiretap
+	flow  gopacket.Flow
+	ports gopacket.Flow
+	conn  *Conn
+	seen  time.Time
+	lost  int
+
+	incomplete bool
 }
 
-func NewStream(tap *Wiretap, netFlow, tcpFlow gopacket.Flow) *Stream {
-	return &Stream{
+func NewStream(tap *Wiretap, netFlow, tcpFlow gopacket.Flow, conn *Conn) *Stream {
+	st := &Stream{
 		ReaderStream: tcpreader.NewReaderStream(),
 		tap:          tap,
 		flow:         netFlow,
+		ports:        tcpFlow,
+		conn:         conn,
+	}
+
+	/* Report gaps in the data, so requests are not silently truncated. */
+	st.ReaderStream.LossErrors = true
+	return st
+}
+
+func (st *Stream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	/* The reader stream blocks until the data is consumed, so the timestamp
+	   always belongs to the data that is currently being parsed. */
+	if len(reassembly) > 0 {
+		st.seen = reassembly[0].Seen
+	}
+
+	/* A negative skip means the start of the stream was missed, its size
+	   is unknown. */
+	for _, r := range reassembly {
+		if r.Skip > 0 {
+			st.lost += r.Skip
+			atomic.AddInt64(&st.tap.Stats.BytesLost, int64(r.Skip))
+		}
 	}
+	st.ReaderStream.Reassembled(reassembly)
 }
 
 func (st *Stream) Consume() {
+	defer func() {
+		if st.lost > 0 && st.tap.Verbose {
+			st.tap.Log("%s lost %d bytes", st.flow.Src().String(), st.lost)
+		}
+	}()
+
 	buf := bufio.NewReader(st)
+	if st.tap.KeyLog != nil && st.conn != nil && isTLS(buf) {
+		buf = bufio.NewReader(newTLSReader(buf, st.conn.tlsSession(st.tap.KeyLog), true))
+	}
+
+	if isH2CPreface(buf) {
+		st.consumeH2C(buf)
+		return
+	}
 
 	for {
 		req, err := http.ReadRequest(buf)
@@ -38,37 +100,352 @@ func (st *Stream) Consume() {
 			return
 		} else if err != nil {
 			st.tap.Log("Error: %s", err)
+			if st.resync(buf) != nil {
+				return
+			}
+		} else if isWebSocketUpgrade(req) {
+			st.exchange(req)
+			st.mirrorWebSocket(req, buf)
+			return
+		} else if isH2CUpgrade(req) {
+			/* The upgrade request is answered over HTTP/2 as the first stream,
+			   after the client has sent its connection preface. */
+			req.Header.Del("Upgrade")
+			req.Header.Del("Http2-Settings")
+			req.Header.Del("Connection")
+			st.forward(req, st.exchange(req))
+			st.consumeH2C(buf)
+			return
+		} else if req.Method == "CONNECT" || req.Header.Get("Upgrade") != "" {
+			/* Tunneled data cannot be mirrored, but upgrade requests themselves
+			   are forwarded like any other request. */
+			ex := st.exchange(req)
+			if req.Method != "CONNECT" {
+				st.forward(req, ex)
+			}
+
+			if st.tunneled(req, ex, buf) {
+				st.tunnel(req, buf)
+				return
+			}
 		} else {
-			st.forward(req)
+			st.forward(req, st.exchange(req))
+		}
+
+		/* The remainder of an incomplete request follows the gap. */
+		if st.incomplete {
+			st.incomplete = false
+			if st.skip(buf) != nil {
+				return
+			}
 		}
 	}
 }
 
-func (st *Stream) forward(req *http.Request) {
+func (st *Stream) resync(buf *bufio.Reader) error {
+	/* The request that failed to parse is lost, but its response still takes
+	   a place in the pipeline. */
+	atomic.AddInt64(&st.tap.Stats.LostRequests, 1)
+	st.exchange(nil)
+
+	return st.skip(buf)
+}
+
+func (st *Stream) skip(buf *bufio.Reader) error {
+	var skipped int
+	defer func() {
+		atomic.AddInt64(&st.tap.Stats.SkippedBytes, int64(skipped))
+		if skipped > 0 {
+			st.tap.Log("Skipped %d bytes to the next request", skipped)
+		}
+	}()
+
+	for {
+		line, err := peekLine(buf)
+		if err == nil && requestLine.Match(line) {
+			return nil
+		} else if err == tcpreader.DataLost {
+			continue
+		} else if err != nil {
+			skipped += buf.Buffered()
+			return err
+		}
+
+		n, _ := buf.Discard(len(line))
+		skipped += n
+	}
+}
+
+func peekLine(buf *bufio.Reader) ([]byte, error) {
+	for n := 1; ; n = buf.Buffered() + 1 {
+		if n > buf.Size() {
+			/* Longer than any request line. */
+			return buf.Peek(buf.Buffered())
+		}
+
+		b, err := buf.Peek(n)
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return b[:i+1], nil
+		} else if err != nil {
+			return b, err
+		}
+	}
+}
+
+func (st *Stream) tunnel(req *http.Request, buf *bufio.Reader) {
+	atomic.AddInt64(&st.tap.Stats.Tunnels, 1)
+	st.tap.Log("%s %s %s (TUNNEL)", st.flow.Src().String(), req.Method, req.RequestURI)
+	tcpreader.DiscardBytesToEOF(buf)
+}
+
+func (st *Stream) tunneled(req *http.Request, ex *Exchange, buf *bufio.Reader) bool {
+	if ex != nil {
+		/* Keep consuming what the client sends while waiting, so that the
+		   assembler can deliver the response. The buffer is only used again
+		   once the peek has finished. */
+		peeked := make(chan struct{})
+		go func() {
+			buf.Peek(1)
+			close(peeked)
+		}()
+
+		res := ex.Wait(st.tap.ResponseTimeout)
+		<-peeked
+
+		if res != nil {
+			return isTunnelResponse(req, res.StatusCode)
+		}
+	}
+
+	/* Without a response, a rejected upgrade is recognized by the request
+	   that follows it, anything else belongs to the new protocol. */
+	return req.Method == "CONNECT" || !looksLikeRequest(buf)
+}
+
+func isTunnelResponse(req *http.Request, status int) bool {
+	return status == http.StatusSwitchingProtocols ||
+		req != nil && req.Method == "CONNECT" && status >= 200 && status < 300
+}
+
+func looksLikeRequest(buf *bufio.Reader) bool {
+	/* Requests start with an uppercase method token, followed by a space. */
+	for n := 1; n <= 16; n++ {
+		b, err := buf.Peek(n)
+		if err != nil {
+			return false
+		}
+
+		if c := b[n-1]; c == ' ' {
+			return n > 1
+		} else if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return false
+}
+
+func (st *Stream) exchange(req *http.Request) *Exchange {
+	/* Every request is paired with a response, including the ones that
+	   are not forwarded, to keep the pipeline order intact. */
+	if st.conn == nil {
+		return nil
+	}
+	return st.conn.push(req)
+}
+
+func (st *Stream) forward(req *http.Request, ex *Exchange) {
+	if !st.accept(req) {
+		return
+	}
+
+	dsts := st.route(req)
+	if st.streamable(req, dsts) {
+		st.stream(req, ex, dsts[0])
+		return
+	}
+
+	body, err := ReadBody(req.Body, st.tap.MaxBody, st.tap.BodyPolicy)
+	if err != nil {
+		st.tap.Log("Error: %s", err)
+		st.incomplete = true
+		atomic.AddInt64(&st.tap.Stats.IncompleteRequests, 1)
+	}
+
+	st.forwardBody(req, ex, body, dsts)
+}
+
+func (st *Stream) accept(req *http.Request) bool {
+	atomic.AddInt64(&st.tap.Stats.Requests, 1)
+
 	req.URL.Scheme = "http"
 	req.URL.Host = req.Host
 
 	if len(st.tap.Methods) > 0 && !st.tap.Methods[req.Method] {
+		return false
+	}
+
+	if len(st.tap.GRPCMethods) > 0 && isGRPC(req) && !st.tap.GRPCMethods[req.URL.Path] {
+		return false
+	}
+	return true
+}
+
+func (st *Stream) forwardBody(req *http.Request, ex *Exchange, body *Body, dsts DestinationList) {
+	defer body.release()
+
+	if body.Truncated || body.Skipped {
+		atomic.AddInt64(&st.tap.Stats.LargeBodies, 1)
+	}
+
+	if body.Skipped {
+		st.tap.Log("%s %s %s (TOO LARGE)", st.flow.Src().String(), req.Method, req.URL)
 		return
 	}
 
-	body := new(bytes.Buffer)
-	if _, err := io.Copy(body, req.Body); err != nil {
-		st.tap.Log("Error: %s", err)
+	if st.tap.Recorder != nil {
+		st.record(req, body)
+	}
+
+	if st.incomplete && st.tap.DropIncomplete {
+		st.tap.Log("%s %s %s (INCOMPLETE)", st.flow.Src().String(), req.Method, req.URL)
+		return
 	}
 
 	st.replaceHeaders(req)
 
-	for _, dst := range st.tap.Destinations {
-		n := st.forwardCount()
+	/* The baseline response is only needed to filter noise from diffs. */
+	var baseline *Exchange
+	if ex != nil && st.tap.Differ != nil && st.tap.Destinations.Has(BaselineRole) {
+		baseline = newExchange(req)
+	}
+
+	for _, dst := range dsts {
+		n := 1
+		if dst.Role != BaselineRole {
+			n = st.forwardCount(req)
+		}
+
 		for i := 0; i < n; i++ {
-			copy := st.copy(req, body, dst)
-			repeat := i > 0
-			time.AfterFunc(time.Duration(i)*st.tap.RepeatDelay, func() {
-				st.send(copy, req.URL.String(), repeat)
-			})
+			m := &mirror{
+				dst:        dst,
+				req:        st.copy(req, body, dst),
+				url:        req.URL.String(),
+				repeat:     i > 0,
+				production: ex,
+				baseline:   baseline,
+				incomplete: st.incomplete,
+				truncated:  body.Truncated,
+				body:       body,
+			}
+
+			body.retain()
+			st.enqueue(m, time.Duration(i)*st.tap.RepeatDelay)
+		}
+	}
+}
+
+func (st *Stream) enqueue(m *mirror, delay time.Duration) {
+	finish := func(handle func(*mirror)) func() {
+		return func() {
+			defer st.tap.pending.Done()
+			if m.body != nil {
+				defer m.body.release()
+			}
+			handle(m)
 		}
 	}
+
+	st.tap.pending.Add(1)
+	push := func() {
+		m.dst.Queue.Push(finish(st.send), finish(st.drop))
+	}
+
+	if delay > 0 {
+		time.AfterFunc(delay, push)
+	} else {
+		push()
+	}
+}
+
+func (st *Stream) route(req *http.Request) DestinationList {
+	return st.tap.Destinations.Route(st.point(req, st.tap.Sticky, "route"))
+}
+
+func (st *Stream) streamable(req *http.Request, dsts DestinationList) bool {
+	/* Bodies are only buffered when they are needed more than once, or
+	   when they would otherwise stall capturing while waiting in the queue. */
+	tap := st.tap
+	return tap.StreamBodies && req.ContentLength != 0 && len(dsts) == 1 && tap.Multiply == 1 &&
+		tap.Recorder == nil && tap.Differ == nil && !tap.DropIncomplete &&
+		(tap.MaxBody <= 0 || tap.BodyPolicy == SpoolBody) &&
+		dsts[0].Queue.Idle()
+}
+
+func (st *Stream) stream(req *http.Request, ex *Exchange, dst *Destination) {
+	st.replaceHeaders(req)
+
+	body := newStreamBody()
+
+	m := &mirror{
+		dst:        dst,
+		req:        st.copy(req, NewBody(nil), dst),
+		url:        req.URL.String(),
+		production: ex,
+	}
+	m.req.Body = body
+	m.req.ContentLength = req.ContentLength
+	m.req.TransferEncoding = req.TransferEncoding
+
+	st.enqueue(m, 0)
+
+	/* The body is forwarded as it is captured. If the destination fails or
+	   falls behind, the remainder still has to be consumed before the next
+	   request. */
+	n, err := io.Copy(body, req.Body)
+	if m.req.ContentLength < 0 {
+		dst.charge(n)
+	}
+
+	switch err {
+	case nil:
+	case io.ErrClosedPipe:
+	case errStreamOverflow:
+		st.tap.Log("Error: %s %s", dst, err)
+		atomic.AddInt64(&dst.Dropped, 1)
+		atomic.AddInt64(&st.tap.Stats.Dropped, 1)
+	default:
+		st.tap.Log("Error: %s", err)
+		st.incomplete = true
+		atomic.AddInt64(&st.tap.Stats.IncompleteRequests, 1)
+	}
+
+	body.CloseWithError(err)
+	if err != nil {
+		io.Copy(ioutil.Discard, req.Body)
+	}
+}
+
+func (st *Stream) record(req *http.Request, body *Body) {
+	/* Spooled bodies are larger than the limit, only their beginning is
+	   recorded so that they are never held in memory. */
+	data := body.Head(st.tap.MaxBody)
+
+	err := st.tap.Recorder.Record(&Record{
+		Time:   st.seen,
+		Src:    net.JoinHostPort(st.flow.Src().String(), st.ports.Src().String()),
+		Dst:    net.JoinHostPort(st.flow.Dst().String(), st.ports.Dst().String()),
+		Method: req.Method,
+		URL:    req.RequestURI,
+		Host:   req.Host,
+		Header: req.Header,
+		Body:   data,
+
+		Incomplete: st.incomplete || body.Truncated || int64(len(data)) < body.Len(),
+	})
+
+	if err != nil {
+		st.tap.Log("Error: %s", err)
+	}
 }
 
 func (st *Stream) replaceHeaders(req *http.Request) {
@@ -89,31 +466,148 @@ func (st *Stream) replaceHeaders(req *http.Request) {
 	}
 }
 
-func (st *Stream) send(req *http.Request, url string, repeat bool) {
-	res, err := st.tap.Transport.RoundTrip(req)
+func (st *Stream) send(m *mirror) {
+	req := m.req
+	if !m.dst.admit(req) {
+		st.drop(m)
+		return
+	}
+
+	if m.dst.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), m.dst.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	start := time.Now()
+	res, err := m.dst.Send(req, m.body)
+
+	/* Only transport errors and timeouts count, error responses are exactly
+	   what diffing should report. */
+	m.dst.Breaker.Record(err == nil, time.Since(start))
 	if err != nil {
 		st.tap.Log("Error: %s", err)
+		if m.dst.Role == BaselineRole && m.baseline != nil {
+			m.baseline.complete(nil)
+		}
 	} else {
 		/* "The client must close the response body when finished with it." */
 		defer res.Body.Close()
 
 		var fmt string
-		if repeat {
+		if m.repeat {
 			fmt = "%s %s %s (%s REPEAT) %d"
+		} else if m.dst.Role == BaselineRole {
+			fmt = "%s %s %s (%s BASELINE) %d"
 		} else {
 			fmt = "%s %s %s (%s) %d"
 		}
-		st.tap.Log(fmt, st.flow.Src().String(), req.Method, url, req.URL.Host, res.StatusCode)
+
+		var prod *Response
+		if m.production != nil {
+			prod = m.production.Wait(st.tap.ResponseTimeout)
+		}
+
+		args := []interface{}{st.flow.Src().String(), req.Method, m.url, req.URL.Host, res.StatusCode}
+		if prod != nil {
+			fmt += " (production %d)"
+			args = append(args, prod.StatusCode)
+		}
+		if m.incomplete {
+			fmt += " (incomplete)"
+		}
+		if m.truncated {
+			fmt += " (truncated)"
+		}
+		st.tap.Log(fmt, args...)
 
 		if st.tap.Verbose {
 			req.Body = nil
 			req.Write(os.Stdout)
 		}
+
+		if m.dst.Role == BaselineRole {
+			if m.baseline != nil {
+				m.baseline.complete(st.response(res))
+			}
+		} else if prod != nil && st.tap.Differ != nil && !m.repeat {
+			st.diff(m, st.response(res), prod)
+		}
+	}
+}
+
+func (st *Stream) drop(m *mirror) {
+	atomic.AddInt64(&m.dst.Dropped, 1)
+	atomic.AddInt64(&st.tap.Stats.Dropped, 1)
+
+	/* Let a streamed body continue to be consumed. */
+	if m.req.Body != nil {
+		m.req.Body.Close()
+	}
+
+	if m.dst.Role == BaselineRole && m.baseline != nil {
+		m.baseline.complete(nil)
+	}
+
+	if st.tap.Verbose {
+		st.tap.Log("%s %s %s (%s DROPPED)", st.flow.Src().String(), m.req.Method, m.url, m.req.URL.Host)
+	}
+}
+
+func (st *Stream) response(res *http.Response) *Response {
+	body, truncated, err := readResponseBody(res.Body, st.tap.MaxBody)
+	if err != nil {
+		st.tap.Log("Error: %s", err)
+		return nil
+	}
+
+	return &Response{
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
+		Truncated:  truncated,
+	}
+}
+
+func (st *Stream) diff(m *mirror, cand, prod *Response) {
+	if cand == nil {
+		return
+	}
+
+	var base *Response
+	if m.baseline != nil {
+		base = m.baseline.Wait(st.tap.ResponseTimeout)
+	}
+
+	diffs := st.tap.Differ.CompareWithBaseline(prod, cand, base)
+
+	if len(diffs) == 0 {
+		return
+	}
+
+	if st.tap.Reporter != nil {
+		err := st.tap.Reporter.Report(&Mismatch{
+			Time:        st.seen,
+			Src:         st.flow.Src().String(),
+			Method:      m.req.Method,
+			URL:         m.url,
+			Destination: m.req.URL.Host,
+			Differences: diffs,
+		})
+
+		if err != nil {
+			st.tap.Log("Error: %s", err)
+		}
+	} else {
+		for _, diff := range diffs {
+			st.tap.Log("%s %s %s (%s DIFF) %s: %q != %q", st.flow.Src().String(), m.req.Method, m.url, m.req.URL.Host,
+				diff.Field, diff.Production, diff.Candidate)
+		}
 	}
 }
 
-func (st *Stream) copy(req *http.Request, body *bytes.Buffer, dst *net.TCPAddr) *http.Request {
-	host := *dst
+func (st *Stream) copy(req *http.Request, body *Body, dst *Destination) *http.Request {
+	host := *dst.TCPAddr
 
 	/* If the destination IP is unset, use the original destination IP. */
 	if host.IP == nil {
@@ -123,16 +617,30 @@ func (st *Stream) copy(req *http.Request, body *bytes.Buffer, dst *net.TCPAddr)
 	url := *req.URL
 	copy := *req
 	copy.URL = &url
+	copy.URL.Scheme = dst.Scheme
 	copy.URL.Host = host.String()
-	copy.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+	copy.Body = ioutil.NopCloser(body.Reader())
+	copy.ContentLength = body.Len()
+	copy.TransferEncoding = nil
 
 	return &copy
 }
 
-func (st *Stream) forwardCount() int {
+func (st *Stream) point(req *http.Request, key *Key, salt string) float64 {
+	/* Requests with the same key value consistently get the same point,
+	   requests without one are placed randomly. */
+	if key != nil {
+		if value := key.Value(req, st.flow.Src().String()); value != "" {
+			return hashKey(salt, value)
+		}
+	}
+	return rand.Float64()
+}
+
+func (st *Stream) forwardCount(req *http.Request) int {
 	min := int(st.tap.Multiply)
 	prb := st.tap.Multiply - float32(min)
-	if rand.Float32() < prb {
+	if st.point(req, st.tap.SampleKey, "sample") < float64(prb) {
 		return min + 1
 	} else {
 		return min
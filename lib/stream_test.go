@@ -0,0 +1,384 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+func consumeStream(data string) (*Wiretap, string) {
+	return consumeReassemblies(Options{}, nil, tcpassembly.Reassembly{Bytes: []byte(data)})
+}
+
+func consumeReassemblies(opts Options, conn *Conn, reassemblies ...tcpassembly.Reassembly) (*Wiretap, string) {
+	logs := new(bytes.Buffer)
+	tap := NewWiretap(opts)
+	tap.Logger = log.New(logs, "", 0)
+
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, conn)
+	go func() {
+		for _, reassembly := range reassemblies {
+			st.Reassembled([]tcpassembly.Reassembly{reassembly})
+		}
+		st.ReassemblyComplete()
+	}()
+	st.Consume()
+
+	return tap, logs.String()
+}
+
+func TestConsumeStopsParsingAfterConnect(t *testing.T) {
+	tap, logs := consumeStream("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n\x16\x03\x01\x00\x05hello")
+
+	assert.Contains(t, logs, "CONNECT example.com:443 (TUNNEL)")
+	assert.NotContains(t, logs, "Error")
+	assert.Equal(t, tap.Stats.Tunnels, int64(1))
+}
+
+func TestConsumeStopsParsingAfterUpgrade(t *testing.T) {
+	tap, logs := consumeStream("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: custom\r\n\r\n\x00\x01binary")
+
+	assert.Contains(t, logs, "GET / (TUNNEL)")
+	assert.NotContains(t, logs, "Error")
+	assert.Equal(t, tap.Stats.Tunnels, int64(1))
+}
+
+func consumeConversation(opts Options, turns ...string) (*Wiretap, string) {
+	logs := new(bytes.Buffer)
+	tap := NewWiretap(opts)
+	tap.Logger = log.New(logs, "", 0)
+	tap.ResponseTimeout = time.Second
+
+	conn := new(Conn)
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, conn)
+	rs := NewResponseStream(tap, gopacket.Flow{}, conn)
+
+	done := make(chan bool)
+	go func() {
+		st.Consume()
+		done <- true
+	}()
+	go func() {
+		rs.Consume()
+		done <- true
+	}()
+
+	/* Turns alternate between client and server, each is consumed before
+	   the next is delivered, like the assembler does. */
+	for i, data := range turns {
+		var stream tcpassembly.Stream = st
+		if i%2 == 1 {
+			stream = rs
+		}
+		stream.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(data)}})
+	}
+	st.ReassemblyComplete()
+	rs.ReassemblyComplete()
+	<-done
+	<-done
+
+	tap.pending.Wait()
+	return tap, logs.String()
+}
+
+func TestConsumeContinuesAfterRejectedUpgrade(t *testing.T) {
+	host, reqs := createHttpChannel(2)
+	tap := NewWiretap(Options{Destinations: []string{host}})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+	done := make(chan bool)
+	go func() {
+		st.Consume()
+		done <- true
+	}()
+
+	st.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: custom\r\n\r\n")}})
+
+	/* The upgrade request is forwarded before the client sends anything else. */
+	assert.Equal(t, (<-reqs).Header.Get("Upgrade"), "custom")
+
+	st.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n")}})
+	st.ReassemblyComplete()
+
+	assert.Equal(t, (<-reqs).URL.Path, "/next")
+	<-done
+	assert.Equal(t, tap.Stats.Requests, int64(2))
+	assert.Equal(t, tap.Stats.Tunnels, int64(0))
+}
+
+func TestConsumePairsResponsesAfterRejectedUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	tap, logs := consumeConversation(Options{Destinations: []string{server.Listener.Addr().String()}},
+		"GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: custom\r\n\r\n",
+		"HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n",
+		"GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"HTTP/1.1 204 No Content\r\n\r\n")
+
+	assert.Regexp(t, `GET http://example.com/ \(.*\) 200 \(production 400\)`, logs)
+	assert.Regexp(t, `GET http://example.com/next \(.*\) 200 \(production 204\)`, logs)
+	assert.NotContains(t, logs, "Error")
+	assert.Equal(t, tap.Stats.Tunnels, int64(0))
+}
+
+func TestConsumeTunnelsAcceptedConnect(t *testing.T) {
+	tap, logs := consumeConversation(Options{},
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		"HTTP/1.1 200 Connection Established\r\n\r\n",
+		"\x16\x03\x01\x00\x05hello",
+		"\x16\x03\x03\x00\x05world")
+
+	assert.Contains(t, logs, "CONNECT example.com:443 (TUNNEL)")
+	assert.NotContains(t, logs, "Error")
+	assert.Equal(t, tap.Stats.Tunnels, int64(1))
+}
+
+func TestConsumeContinuesAfterRejectedConnect(t *testing.T) {
+	tap, logs := consumeConversation(Options{},
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		"HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n",
+		"GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"HTTP/1.1 204 No Content\r\n\r\n")
+
+	assert.NotContains(t, logs, "TUNNEL")
+	assert.NotContains(t, logs, "Error")
+	assert.Equal(t, tap.Stats.Requests, int64(1))
+}
+
+func TestConsumeResynchronizesAfterGarbage(t *testing.T) {
+	tap, logs := consumeStream("GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"\x00\x01garbage\r\nmore garbage GET / HTTP/1.1\r\n" +
+		"POST /second HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\nfoo" +
+		"GET /third HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	assert.Contains(t, logs, "Skipped")
+	assert.Equal(t, tap.Stats.Requests, int64(3))
+	assert.Equal(t, tap.Stats.LostRequests, int64(1))
+	assert.True(t, tap.Stats.SkippedBytes > 0)
+}
+
+func TestConsumeResyncPairsLostResponses(t *testing.T) {
+	conn := new(Conn)
+	consumeReassemblies(Options{}, conn, tcpassembly.Reassembly{Bytes: []byte("BROKEN\r\n\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n")})
+
+	assert.Nil(t, conn.next().Request)
+	assert.Equal(t, conn.next().Request.URL.Path, "/")
+}
+
+func consumeWithGap(opts Options) (*Wiretap, string) {
+	return consumeReassemblies(opts, nil,
+		tcpassembly.Reassembly{Bytes: []byte("POST /first HTTP/1.1\r\nHost: example.com\r\nContent-Length: 20\r\n\r\nFOO")},
+		tcpassembly.Reassembly{Bytes: []byte("BAZ"), Skip: 14},
+		tcpassembly.Reassembly{Bytes: []byte("GET /second HTTP/1.1\r\nHost: example.com\r\n\r\n")})
+}
+
+func TestConsumeMarksIncompleteRequests(t *testing.T) {
+	tap, logs := consumeWithGap(Options{})
+
+	assert.NotContains(t, logs, "(INCOMPLETE)")
+	assert.Equal(t, tap.Stats.Requests, int64(2))
+	assert.Equal(t, tap.Stats.IncompleteRequests, int64(1))
+	assert.Equal(t, tap.Stats.LostRequests, int64(0))
+	assert.Equal(t, tap.Stats.BytesLost, int64(14))
+}
+
+func TestConsumeDropsIncompleteRequests(t *testing.T) {
+	tap, logs := consumeWithGap(Options{DropIncomplete: true})
+
+	assert.Contains(t, logs, "POST http://example.com/first (INCOMPLETE)")
+	assert.NotContains(t, logs, "/second (INCOMPLETE)")
+	assert.Equal(t, tap.Stats.IncompleteRequests, int64(1))
+}
+
+func TestForwardTruncatesLargeBodies(t *testing.T) {
+	host, reqs := createHttpChannel(1)
+	tap := NewWiretap(Options{Destinations: []string{host}, MaxBody: 3, BodyPolicy: TruncateBody})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader("FOO BAR BAZ"))
+	req.Host = "example.com"
+	NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil).forward(req, nil)
+
+	copy := <-reqs
+	assert.Equal(t, copy.ContentLength, int64(3))
+	assert.Equal(t, string(copy.consumedBody), "FOO")
+	assert.Equal(t, tap.Stats.LargeBodies, int64(1))
+}
+
+func TestRecordLimitsSpooledBodies(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httap")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests.log")
+	tap := NewWiretap(Options{Record: path, MaxBody: 3})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader("FOO BAR BAZ"))
+	NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil).forward(req, nil)
+	tap.Recorder.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	record, err := NewRecordReader(bytes.NewReader(data)).Next()
+	if assert.Nil(t, err) {
+		assert.Equal(t, string(record.Body), "FOO")
+		assert.True(t, record.Incomplete)
+	}
+}
+
+func TestForwardStreamsBodies(t *testing.T) {
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf := make([]byte, 4)
+		for {
+			n, err := io.ReadFull(req.Body, buf)
+			if n > 0 {
+				received <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	tap := NewWiretap(Options{Destinations: []string{server.Listener.Addr().String()}, StreamBodies: true})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	body, writer := io.Pipe()
+	req, _ := http.NewRequest("POST", "/upload", body)
+	req.ContentLength = 8
+
+	done := make(chan bool)
+	go func() {
+		NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil).forward(req, nil)
+		done <- true
+	}()
+
+	/* The first part arrives before the rest of the body is captured. */
+	io.WriteString(writer, "FOO ")
+	assert.Equal(t, <-received, "FOO ")
+	io.WriteString(writer, "BAR!")
+	writer.Close()
+	assert.Equal(t, <-received, "BAR!")
+	<-done
+}
+
+func TestForwardChargesStreamedBodiesOfUnknownLength(t *testing.T) {
+	host, reqs := createHttpChannel(1)
+	tap := NewWiretap(Options{Destinations: []string{host + ",bps=10"}, StreamBodies: true})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader("FOO BAR BAZ FOO BAR BAZ"))
+	req.ContentLength = -1
+	NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil).forward(req, nil)
+
+	assert.Equal(t, string((<-reqs).consumedBody), "FOO BAR BAZ FOO BAR BAZ")
+	assert.False(t, tap.Destinations[0].Bytes.Take(1))
+}
+
+func TestForwardDoesNotWaitForStreamingDestination(t *testing.T) {
+	/* The destination accepts requests, but never reads their bodies. */
+	block := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+
+	tap := NewWiretap(Options{Destinations: []string{server.Listener.Addr().String()}, StreamBodies: true})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	data := strings.Repeat("x", 16*streamBufferSize)
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader(data))
+
+	done := make(chan bool)
+	go func() {
+		NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil).forward(req, nil)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("forward waited for the destination")
+	}
+	assert.Equal(t, tap.Stats.Dropped, int64(1))
+}
+
+func TestForwardBuffersBodiesByDefault(t *testing.T) {
+	host, reqs := createHttpChannel(1)
+	tap := NewWiretap(Options{Destinations: []string{host}})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader("FOO BAR BAZ"))
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+	assert.False(t, st.streamable(req, tap.Destinations))
+
+	st.forward(req, nil)
+	assert.Equal(t, string((<-reqs).consumedBody), "FOO BAR BAZ")
+}
+
+func TestForwardDropsRequestsOverLimit(t *testing.T) {
+	host, reqs := createHttpChannel(1)
+	tap := NewWiretap(Options{Destinations: []string{host + ",rps=1"}})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("FOO BAR BAZ"))
+		st.forward(req, nil)
+	}
+
+	<-reqs
+	tap.pending.Wait()
+	assert.Equal(t, tap.Stats.Dropped, int64(1))
+	assert.Equal(t, tap.Destinations[0].Dropped, int64(1))
+}
+
+func TestForwardCountSamplesByKey(t *testing.T) {
+	tap := NewWiretap(Options{Multiply: 0.5, SampleKey: "cookie:session"})
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "session=abc")
+
+	n := st.forwardCount(req)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, st.forwardCount(req), n)
+	}
+}
+
+func TestForwardKeepsSendingErrorResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	tap := NewWiretap(Options{Destinations: []string{server.Listener.Addr().String() + ",breaker=0.5"}})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+
+	for i := 0; i < 25; i++ {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader("FOO"))
+		st.forward(req, nil)
+	}
+
+	tap.pending.Wait()
+	assert.Equal(t, tap.Destinations[0].Breaker.State(), BreakerClosed)
+	assert.Equal(t, tap.Stats.Dropped, int64(0))
+}
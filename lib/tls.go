@@ -0,0 +1,487 @@
+package httap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	handshakeClientHello = 1
+	handshakeServerHello = 2
+	handshakeFinished    = 20
+
+	extensionSupportedVersions = 43
+
+	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
+
+	maxRecordLength = 16384 + 2048
+)
+
+var (
+	errTLSRecord    = errors.New("tls: malformed record")
+	errTLSHandshake = errors.New("tls: handshake was not captured")
+	errTLSKey       = errors.New("tls: session secret not found in key log")
+	errTLSDecrypt   = errors.New("tls: cannot decrypt record")
+)
+
+/* A server hello with this random is a hello retry request. */
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+type tlsSuite struct {
+	keyLen  int
+	ivLen   int
+	hash    func() hash.Hash
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var tlsSuites = map[uint16]*tlsSuite{
+	0x1301: {16, 12, sha256.New, newGCM},               // TLS_AES_128_GCM_SHA256
+	0x1302: {32, 12, sha512.New384, newGCM},            // TLS_AES_256_GCM_SHA384
+	0x1303: {32, 12, sha256.New, chacha20poly1305.New}, // TLS_CHACHA20_POLY1305_SHA256
+	0x009c: {16, 4, sha256.New, newGCM},                // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {32, 4, sha512.New384, newGCM},             // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0xc02b: {16, 4, sha256.New, newGCM},                // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {32, 4, sha512.New384, newGCM},             // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {16, 4, sha256.New, newGCM},                // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {32, 4, sha512.New384, newGCM},             // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0xcca8: {32, 12, sha256.New, chacha20poly1305.New}, // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0xcca9: {32, 12, sha256.New, chacha20poly1305.New}, // TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+}
+
+type tlsSession struct {
+	keys         *KeyLog
+	clientRandom []byte
+	serverRandom []byte
+	version      uint16
+	suite        uint16
+	clientHello  chan struct{}
+	serverHello  chan struct{}
+}
+
+type tlsCipher struct {
+	aead    cipher.AEAD
+	iv      []byte
+	version uint16
+	seq     uint64
+}
+
+type tlsReader struct {
+	raw       *bufio.Reader
+	session   *tlsSession
+	client    bool
+	cipher    *tlsCipher
+	skipping  bool
+	handshake []byte
+	pending   []byte
+	failed    bool
+}
+
+func isTLS(buf *bufio.Reader) bool {
+	b, err := buf.Peek(3)
+	return err == nil && b[0] >= recordChangeCipherSpec && b[0] <= recordApplicationData && b[1] == 3 && b[2] <= 4
+}
+
+func newTLSSession(keys *KeyLog) *tlsSession {
+	return &tlsSession{
+		keys:        keys,
+		clientHello: make(chan struct{}),
+		serverHello: make(chan struct{}),
+	}
+}
+
+func (s *tlsSession) setClientHello(body []byte) error {
+	if len(body) < 34 {
+		return errTLSRecord
+	}
+
+	/* A client hello is sent again after a hello retry request. */
+	if s.clientRandom == nil {
+		s.clientRandom = append([]byte(nil), body[2:34]...)
+		close(s.clientHello)
+	}
+	return nil
+}
+
+func (s *tlsSession) setServerHello(body []byte) error {
+	if len(body) < 38 {
+		return errTLSRecord
+	}
+
+	version := binary.BigEndian.Uint16(body[0:2])
+	random := body[2:34]
+	if bytes.Equal(random, helloRetryRandom) || s.serverRandom != nil {
+		return nil
+	}
+
+	offset := 35 + int(body[34])
+	if len(body) < offset+3 {
+		return errTLSRecord
+	}
+
+	suite := binary.BigEndian.Uint16(body[offset:])
+	offset += 3
+
+	/* TLS 1.3 negotiates its version with an extension. */
+	if len(body) >= offset+2 {
+		extensions := body[offset+2:]
+		for len(extensions) >= 4 {
+			typ := binary.BigEndian.Uint16(extensions[0:2])
+			length := int(binary.BigEndian.Uint16(extensions[2:4]))
+			if len(extensions) < 4+length {
+				return errTLSRecord
+			}
+			if typ == extensionSupportedVersions && length == 2 {
+				version = binary.BigEndian.Uint16(extensions[4:6])
+			}
+			extensions = extensions[4+length:]
+		}
+	}
+
+	s.serverRandom = append([]byte(nil), random...)
+	s.version = version
+	s.suite = suite
+	close(s.serverHello)
+	return nil
+}
+
+func (s *tlsSession) waitForHellos() error {
+	/* Hellos are parsed before any encrypted data arrives in practice, because
+	   the assembler waits for each stream to consume the data it was given. */
+	for _, hello := range []chan struct{}{s.clientHello, s.serverHello} {
+		select {
+		case <-hello:
+		case <-time.After(time.Second):
+			return errTLSHandshake
+		}
+	}
+	return nil
+}
+
+func (s *tlsSession) cipher12(client bool) (*tlsCipher, error) {
+	suite := tlsSuites[s.suite]
+	if suite == nil {
+		return nil, fmt.Errorf("tls: unsupported cipher suite %#04x", s.suite)
+	}
+
+	master := s.keys.Lookup("CLIENT_RANDOM", s.clientRandom)
+	if master == nil {
+		return nil, errTLSKey
+	}
+
+	/* The key block holds client and server keys, followed by their IVs. AEAD
+	   suites have no MAC keys. */
+	seed := append(append([]byte(nil), s.serverRandom...), s.clientRandom...)
+	block := prf12(suite.hash, master, "key expansion", seed, 2*suite.keyLen+2*suite.ivLen)
+	key, iv := block[suite.keyLen:2*suite.keyLen], block[2*suite.keyLen+suite.ivLen:]
+	if client {
+		key, iv = block[:suite.keyLen], block[2*suite.keyLen:2*suite.keyLen+suite.ivLen]
+	}
+
+	return newTLSCipher(suite, key, iv, versionTLS12)
+}
+
+func (s *tlsSession) cipher13(client, handshake bool) (*tlsCipher, error) {
+	suite := tlsSuites[s.suite]
+	if suite == nil {
+		return nil, fmt.Errorf("tls: unsupported cipher suite %#04x", s.suite)
+	}
+
+	var label string
+	switch {
+	case client && handshake:
+		label = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	case client:
+		label = "CLIENT_TRAFFIC_SECRET_0"
+	case handshake:
+		label = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	default:
+		label = "SERVER_TRAFFIC_SECRET_0"
+	}
+
+	secret := s.keys.Lookup(label, s.clientRandom)
+	if secret == nil {
+		return nil, errTLSKey
+	}
+
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	iv := hkdfExpandLabel(suite.hash, secret, "iv", 12)
+	return newTLSCipher(suite, key, iv, versionTLS13)
+}
+
+func newTLSCipher(suite *tlsSuite, key, iv []byte, version uint16) (*tlsCipher, error) {
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsCipher{aead: aead, iv: iv, version: version}, nil
+}
+
+func (c *tlsCipher) decrypt(header, payload []byte) (byte, []byte, error) {
+	typ := header[0]
+	ciphertext := payload
+	additional := header
+
+	var nonce []byte
+	if len(c.iv) == c.aead.NonceSize() {
+		/* TLS 1.3 and ChaCha20 suites derive the nonce from the sequence number. */
+		nonce = make([]byte, len(c.iv))
+		copy(nonce, c.iv)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(c.seq >> uint(8*i))
+		}
+	} else {
+		/* TLS 1.2 GCM suites send the rest of the nonce with each record. */
+		explicit := c.aead.NonceSize() - len(c.iv)
+		if len(payload) < explicit {
+			return 0, nil, errTLSRecord
+		}
+		nonce = append(append([]byte(nil), c.iv...), payload[:explicit]...)
+		ciphertext = payload[explicit:]
+	}
+
+	if c.version != versionTLS13 {
+		if len(ciphertext) < c.aead.Overhead() {
+			return 0, nil, errTLSRecord
+		}
+		additional = make([]byte, 13)
+		binary.BigEndian.PutUint64(additional, c.seq)
+		copy(additional[8:], header[:3])
+		binary.BigEndian.PutUint16(additional[11:], uint16(len(ciphertext)-c.aead.Overhead()))
+	}
+
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return 0, nil, errTLSDecrypt
+	}
+	c.seq++
+
+	if c.version == versionTLS13 {
+		/* The real content type follows the content, before any padding. */
+		i := len(plaintext) - 1
+		for i >= 0 && plaintext[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, errTLSRecord
+		}
+		typ, plaintext = plaintext[i], plaintext[:i]
+	}
+
+	return typ, plaintext, nil
+}
+
+func newTLSReader(raw *bufio.Reader, session *tlsSession, client bool) *tlsReader {
+	return &tlsReader{raw: raw, session: session, client: client}
+}
+
+func (r *tlsReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.failed {
+			/* Keep consuming, the assembler waits until the stream is read. */
+			tcpreader.DiscardBytesToEOF(r.raw)
+			return 0, io.EOF
+		}
+
+		if err := r.readRecord(); err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil {
+			r.failed = true
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *tlsReader) readRecord() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r.raw, header); err != nil {
+		return err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if length > maxRecordLength {
+		return errTLSRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.raw, payload); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	switch typ := header[0]; {
+	case typ == recordChangeCipherSpec:
+		return r.changeCipherSpec()
+	case typ == recordHandshake && r.cipher == nil:
+		return r.readHandshake(payload)
+	case typ == recordApplicationData || r.cipher != nil:
+		return r.readEncrypted(header, payload)
+	}
+	return nil
+}
+
+func (r *tlsReader) changeCipherSpec() error {
+	if err := r.session.waitForHellos(); err != nil {
+		return err
+	}
+
+	/* TLS 1.3 only sends change cipher spec for compatibility. */
+	if r.session.version == versionTLS13 {
+		return nil
+	}
+
+	var err error
+	r.cipher, err = r.session.cipher12(r.client)
+	return err
+}
+
+func (r *tlsReader) readHandshake(data []byte) error {
+	r.handshake = append(r.handshake, data...)
+
+	for len(r.handshake) >= 4 {
+		length := int(r.handshake[1])<<16 | int(r.handshake[2])<<8 | int(r.handshake[3])
+		if len(r.handshake) < 4+length {
+			return nil
+		}
+
+		typ, body := r.handshake[0], r.handshake[4:4+length]
+		r.handshake = r.handshake[4+length:]
+
+		var err error
+		switch {
+		case typ == handshakeClientHello && r.cipher == nil:
+			err = r.session.setClientHello(body)
+		case typ == handshakeServerHello && r.cipher == nil:
+			err = r.session.setServerHello(body)
+		case typ == handshakeFinished && r.session.version == versionTLS13:
+			/* Application data follows the finished message. */
+			r.cipher, err = r.session.cipher13(r.client, false)
+			r.handshake = nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *tlsReader) readEncrypted(header, payload []byte) error {
+	if r.cipher == nil {
+		if err := r.startTLS13(); err != nil {
+			return err
+		}
+	}
+
+	typ, plaintext, err := r.cipher.decrypt(header, payload)
+	if err != nil && r.skipping {
+		/* Handshake records for which no secret was logged. */
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.skipping = false
+
+	switch typ {
+	case recordApplicationData:
+		r.pending = plaintext
+	case recordHandshake:
+		if r.session.version == versionTLS13 {
+			return r.readHandshake(plaintext)
+		}
+	}
+	return nil
+}
+
+func (r *tlsReader) startTLS13() error {
+	/* Encrypted data without a preceding change cipher spec is only valid
+	   for TLS 1.3, which encrypts the remainder of the handshake. */
+	if err := r.session.waitForHellos(); err != nil {
+		return err
+	}
+
+	if r.session.version != versionTLS13 {
+		return errTLSHandshake
+	}
+
+	var err error
+	r.cipher, err = r.session.cipher13(r.client, true)
+	if err == errTLSKey {
+		/* Without handshake secrets, skip ahead to the application data. */
+		r.cipher, err = r.session.cipher13(r.client, false)
+		r.skipping = true
+	}
+	return err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func prf12(hash func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(hash, secret)
+
+	var out []byte
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+func hkdfExpandLabel(hash func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := append([]byte{byte(n >> 8), byte(n), byte(len(label))}, label...)
+	info = append(info, 0)
+	mac := hmac.New(hash, secret)
+
+	var out, t []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
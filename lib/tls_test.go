@@ -0,0 +1,165 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type recordingConn struct {
+	net.Conn
+	written *bytes.Buffer
+	mutex   *sync.Mutex
+}
+
+func (rc recordingConn) Write(p []byte) (int, error) {
+	rc.mutex.Lock()
+	rc.written.Write(p)
+	rc.mutex.Unlock()
+	return rc.Conn.Write(p)
+}
+
+func testCertificate() tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+/*
+Performs a TLS session and returns the bytes sent by each side and the
+
+	key log written by the client.
+*/
+func captureTLSSession(version uint16, suite uint16) (client, server, keys []byte) {
+	clientRaw, serverRaw := net.Pipe()
+	var mutex sync.Mutex
+	clientBuf, serverBuf, keyBuf := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+
+	clientConf := &tls.Config{InsecureSkipVerify: true, MinVersion: version, MaxVersion: version, KeyLogWriter: keyBuf}
+	if suite != 0 {
+		clientConf.CipherSuites = []uint16{suite}
+	}
+	serverConf := &tls.Config{Certificates: []tls.Certificate{testCertificate()}, MinVersion: version, MaxVersion: version}
+
+	done := make(chan bool)
+	go func() {
+		conn := tls.Server(recordingConn{serverRaw, serverBuf, &mutex}, serverConf)
+		req, _ := http.ReadRequest(bufio.NewReader(conn))
+		ioutil.ReadAll(req.Body)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+		conn.Close()
+		done <- true
+	}()
+
+	conn := tls.Client(recordingConn{clientRaw, clientBuf, &mutex}, clientConf)
+	conn.Write([]byte("POST /secret HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\nfoo"))
+	ioutil.ReadAll(conn)
+	<-done
+
+	return clientBuf.Bytes(), serverBuf.Bytes(), keyBuf.Bytes()
+}
+
+type decryptedSession struct {
+	req *http.Request
+	res *http.Response
+}
+
+func decryptTLSSession(client, server, keys []byte) decryptedSession {
+	keyLog := &KeyLog{secrets: make(map[string][]byte)}
+	keyLog.load(bytes.NewReader(keys))
+	session := newTLSSession(keyLog)
+
+	clientBuf := bufio.NewReader(bytes.NewReader(client))
+	serverBuf := bufio.NewReader(bytes.NewReader(server))
+	if !isTLS(clientBuf) || !isTLS(serverBuf) {
+		return decryptedSession{}
+	}
+
+	reqs := make(chan *http.Request, 1)
+	go func() {
+		req, _ := http.ReadRequest(bufio.NewReader(newTLSReader(clientBuf, session, true)))
+		reqs <- req
+	}()
+
+	res, _ := http.ReadResponse(bufio.NewReader(newTLSReader(serverBuf, session, false)), nil)
+	return decryptedSession{<-reqs, res}
+}
+
+func assertDecrypted(t *testing.T, session decryptedSession) {
+	if assert.NotNil(t, session.req) {
+		body, _ := ioutil.ReadAll(session.req.Body)
+		assert.Equal(t, session.req.URL.Path, "/secret")
+		assert.Equal(t, session.req.Host, "example.com")
+		assert.Equal(t, string(body), "foo")
+	}
+
+	if assert.NotNil(t, session.res) {
+		body, _ := ioutil.ReadAll(session.res.Body)
+		assert.Equal(t, session.res.StatusCode, 200)
+		assert.Equal(t, string(body), "hello")
+	}
+}
+
+func TestDecryptTLS12AESGCM(t *testing.T) {
+	assertDecrypted(t, decryptTLSSession(captureTLSSession(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)))
+	assertDecrypted(t, decryptTLSSession(captureTLSSession(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384)))
+}
+
+func TestDecryptTLS12ChaCha20(t *testing.T) {
+	assertDecrypted(t, decryptTLSSession(captureTLSSession(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305)))
+}
+
+func TestDecryptTLS13(t *testing.T) {
+	assertDecrypted(t, decryptTLSSession(captureTLSSession(tls.VersionTLS13, 0)))
+}
+
+func TestDecryptTLS13WithoutHandshakeSecrets(t *testing.T) {
+	client, server, keys := captureTLSSession(tls.VersionTLS13, 0)
+
+	var filtered []string
+	for _, line := range strings.Split(string(keys), "\n") {
+		if !strings.Contains(line, "HANDSHAKE") {
+			filtered = append(filtered, line)
+		}
+	}
+
+	assertDecrypted(t, decryptTLSSession(client, server, []byte(strings.Join(filtered, "\n"))))
+}
+
+func TestDecryptTLSWithoutKeys(t *testing.T) {
+	client, server, _ := captureTLSSession(tls.VersionTLS12, 0)
+	session := decryptTLSSession(client, server, nil)
+
+	assert.Nil(t, session.req)
+	assert.Nil(t, session.res)
+}
+
+func TestKeyLogLookup(t *testing.T) {
+	keyLog := &KeyLog{secrets: make(map[string][]byte)}
+	keyLog.load(strings.NewReader("# comment\nCLIENT_RANDOM 0102 abcd\nCLIENT_TRAFFIC_SECRET_0 0102 ef01\nCLIENT_RANDOM 0304"))
+
+	assert.Equal(t, keyLog.Lookup("CLIENT_RANDOM", []byte{1, 2}), []byte{0xab, 0xcd})
+	assert.Equal(t, keyLog.Lookup("CLIENT_TRAFFIC_SECRET_0", []byte{1, 2}), []byte{0xef, 0x01})
+	assert.Nil(t, keyLog.Lookup("CLIENT_RANDOM", []byte{3, 4}))
+}
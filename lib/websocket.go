@@ -0,0 +1,218 @@
+package httap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+const (
+	wsOpClose      = 0x8
+	wsMaxFrameSize = 1 << 24
+)
+
+var errWebSocketFrame = errors.New("websocket frame too large")
+
+type wsSession struct {
+	dst    *Destination
+	frames chan []byte
+}
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	return strings.ToLower(req.Header.Get("Upgrade")) == "websocket"
+}
+
+func (st *Stream) mirrorWebSocket(req *http.Request, buf *bufio.Reader) {
+	defer tcpreader.DiscardBytesToEOF(buf)
+
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+
+	if len(st.tap.Methods) > 0 && !st.tap.Methods[req.Method] {
+		return
+	}
+
+	st.replaceHeaders(req)
+
+	/* Baselines only serve to filter response diffs, which do not apply. */
+	var sessions []*wsSession
+	for _, dst := range st.route(req) {
+		if dst.Role != BaselineRole {
+			sessions = append(sessions, st.openWebSocket(req, dst))
+		}
+	}
+
+	defer func() {
+		for _, session := range sessions {
+			close(session.frames)
+		}
+	}()
+
+	/* Client frames are masked, which any server accepts, so they are
+	   forwarded unchanged. */
+	for {
+		frame, err := readWebSocketFrame(buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		} else if err != nil {
+			st.tap.Log("Error: %s", err)
+			return
+		}
+
+		active := sessions[:0]
+		for _, session := range sessions {
+			select {
+			case session.frames <- frame:
+				active = append(active, session)
+			default:
+				/* Never block capturing on a slow destination. Dropping a single
+				   frame would corrupt the session, so it is closed instead. */
+				st.tap.Log("Error: websocket to %s is not keeping up, closing it", session.dst)
+				close(session.frames)
+			}
+		}
+		sessions = active
+
+		if frame[0]&0x0f == wsOpClose {
+			return
+		}
+	}
+}
+
+func (st *Stream) openWebSocket(req *http.Request, dst *Destination) *wsSession {
+	copy := st.copy(req, NewBody(nil), dst)
+	url := req.URL.String()
+
+	/* The handshake waits for a worker like any other request. Frames are
+	   buffered in the meantime, so capturing never waits on a destination. */
+	session := &wsSession{dst: dst, frames: make(chan []byte, 1024)}
+
+	st.tap.pending.Add(1)
+	dst.Queue.Push(func() {
+		if !dst.admit(copy) {
+			st.drop(&mirror{dst: dst, req: copy, url: url})
+			go st.relayWebSocket(session, nil)
+			return
+		}
+
+		start := time.Now()
+		conn, status, err := st.handshakeWebSocket(copy, dst)
+		dst.Breaker.Record(err == nil || status > 0, time.Since(start))
+
+		if status > 0 {
+			st.tap.Log("%s %s %s (%s WEBSOCKET) %d", st.flow.Src().String(), copy.Method, url, copy.URL.Host, status)
+		}
+		if err != nil {
+			st.tap.Log("Error: %s", err)
+		}
+		go st.relayWebSocket(session, conn)
+	}, func() {
+		st.drop(&mirror{dst: dst, req: copy, url: url})
+		go st.relayWebSocket(session, nil)
+	})
+
+	return session
+}
+
+func (st *Stream) handshakeWebSocket(req *http.Request, dst *Destination) (net.Conn, int, error) {
+	conn, err := dst.Dial(req.URL.Host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	/* A destination that accepts connections but never answers must not
+	   hold on to a worker. */
+	if dst.HeaderTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(dst.HeaderTimeout))
+	}
+
+	reader := bufio.NewReader(conn)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, res.StatusCode, errors.New("websocket handshake rejected by " + dst.String())
+	}
+	conn.SetDeadline(time.Time{})
+
+	/* Server frames are read and discarded so the destination never blocks
+	   on a full socket buffer. */
+	go io.Copy(ioutil.Discard, reader)
+
+	return conn, res.StatusCode, nil
+}
+
+func (st *Stream) relayWebSocket(session *wsSession, conn net.Conn) {
+	defer st.tap.pending.Done()
+
+	if conn != nil {
+		defer conn.Close()
+
+		for frame := range session.frames {
+			if _, err := conn.Write(frame); err != nil {
+				st.tap.Log("Error: %s", err)
+				break
+			}
+		}
+	}
+
+	/* Keep draining so that the stream parser never blocks. */
+	for range session.frames {
+	}
+}
+
+func readWebSocketFrame(buf *bufio.Reader) ([]byte, error) {
+	header, err := buf.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 2
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+
+	if header, err = buf.Peek(size); err != nil {
+		return nil, err
+	}
+
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header[2:]))
+	case 127:
+		length = binary.BigEndian.Uint64(header[2:])
+	}
+
+	if length > wsMaxFrameSize {
+		return nil, errWebSocketFrame
+	}
+
+	frame := make([]byte, size+int(length))
+	if _, err := io.ReadFull(buf, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
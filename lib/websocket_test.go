@@ -0,0 +1,126 @@
+package httap
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func maskedFrame(opcode byte, payload string) []byte {
+	key := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, key...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^key[i%4])
+	}
+	return frame
+}
+
+func TestMirrorWebSocketForwardsFrames(t *testing.T) {
+	listener, _ := net.Listen("tcp", "localhost:0")
+	defer listener.Close()
+
+	frames := make(chan []byte, 3)
+	handshakes := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := bufio.NewReader(conn)
+		req, _ := http.ReadRequest(buf)
+		handshakes <- req
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+		for {
+			frame, err := readWebSocketFrame(buf)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	tap := NewWiretap(Options{Destinations: []string{listener.Addr().String()}})
+
+	data := bytes.NewBufferString("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	data.Write(maskedFrame(0x1, "hello"))
+	data.Write(maskedFrame(0x1, "world"))
+	data.Write(maskedFrame(wsOpClose, ""))
+
+	buf := bufio.NewReader(data)
+	req, _ := http.ReadRequest(buf)
+	assert.True(t, isWebSocketUpgrade(req))
+
+	NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil).mirrorWebSocket(req, buf)
+	tap.pending.Wait()
+
+	handshake := <-handshakes
+	assert.Equal(t, handshake.URL.Path, "/chat")
+	assert.Equal(t, handshake.Header.Get("Sec-WebSocket-Key"), "dGhlIHNhbXBsZSBub25jZQ==")
+
+	assert.Equal(t, <-frames, maskedFrame(0x1, "hello"))
+	assert.Equal(t, <-frames, maskedFrame(0x1, "world"))
+	assert.Equal(t, <-frames, maskedFrame(wsOpClose, ""))
+}
+
+func TestMirrorWebSocketDoesNotWaitForDestination(t *testing.T) {
+	listener, _ := net.Listen("tcp", "localhost:0")
+	defer listener.Close()
+
+	/* The destination accepts connections, but never answers. */
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tap := NewWiretap(Options{Destinations: []string{listener.Addr().String() + ",header-timeout=500ms,rps=1"}})
+	tap.Logger = log.New(new(bytes.Buffer), "", 0)
+	st := NewStream(tap, gopacket.Flow{}, gopacket.Flow{}, nil)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		data := bytes.NewBufferString("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		data.Write(maskedFrame(0x1, "hello"))
+
+		buf := bufio.NewReader(data)
+		req, _ := http.ReadRequest(buf)
+		st.mirrorWebSocket(req, buf)
+	}
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+
+	tap.pending.Wait()
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	/* The second session exceeds the request rate. */
+	assert.Equal(t, tap.Stats.Dropped, int64(1))
+}
+
+func TestReadWebSocketFrameExtendedLength(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 300)
+	data := append([]byte{0x82, 126, 0x01, 0x2c}, payload...)
+
+	frame, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, frame, data)
+
+	_, err = readWebSocketFrame(bufio.NewReader(bytes.NewReader([]byte{0x82, 127, 0xff, 0, 0, 0, 0, 0, 0, 0})))
+	assert.Equal(t, err, errWebSocketFrame)
+}
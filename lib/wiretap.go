@@ -1,12 +1,15 @@
 package httap
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -16,40 +19,103 @@ import (
 )
 
 type Wiretap struct {
-	Sources      AddrList
-	Destinations AddrList
-	Interfaces   []string
-	Headers      map[string]string
-	Methods      map[string]bool
-	Multiply     float32
-	RepeatDelay  time.Duration
-	Logger       *log.Logger
-	Verbose      bool
-	BufSize      int32
-	Timeout      time.Duration
-	Transport    http.Transport
+	Sources         AddrList
+	Destinations    DestinationList
+	Interfaces      []string
+	ReadFile        string
+	Speed           float64
+	Headers         map[string]string
+	Methods         map[string]bool
+	GRPCMethods     map[string]bool
+	Sticky          *Key
+	SampleKey       *Key
+	Multiply        float32
+	DropIncomplete  bool
+	StreamBodies    bool
+	MaxBody         int64
+	BodyPolicy      string
+	Recorder        *Recorder
+	Differ          *Differ
+	Reporter        *Reporter
+	RepeatDelay     time.Duration
+	Logger          *log.Logger
+	Verbose         bool
+	BufSize         int32
+	Timeout         time.Duration
+	MaxPages        int
+	MaxConnPages    int
+	FlushInterval   time.Duration
+	IdleTimeout     time.Duration
+	Responses       bool
+	KeyLog          *KeyLog
+	ResponseTimeout time.Duration
+	Stats           *Stats
+	pending         sync.WaitGroup
+	conns           map[[2]gopacket.Flow]*Conn
+	connMutex       sync.Mutex
 }
 
 type Options struct {
-	Sources      []string `short:"s" long:"src"      description:"Source(s) to wiretap HTTP traffic from." value-name:"HOST[:PORT]" default:"*:80" default-mask:"*:80 by default"`
-	Destinations []string `short:"d" long:"dst"      description:"Destination(s) to forward copy of HTTP traffic to." value-name:"HOST[:PORT]" required:"true"`
-	Headers      []string `short:"H" long:"header"   description:"Set or replace request header in duplicated traffic." value-name:"LINE"`
-	Methods      []string `short:"m" long:"method"   description:"Only forward requests with specific HTTP methods." value-name:"VERB"`
-	Multiply     float32  `short:"n" long:"multiply" description:"Increase or reduce the number of requests by a factor." value-name:"N"`
-	Verbose      bool     `short:"v" long:"verbose"  description:"Show extra information, including all request headers."`
+	Sources        []string      `short:"s" long:"src"      description:"Source(s) to wiretap HTTP traffic from." value-name:"HOST[:PORT]" default:"*:80" default-mask:"*:80 by default"`
+	Destinations   []string      `short:"d" long:"dst"      description:"Destination(s) to forward copy of HTTP traffic to, optionally followed by destination options." value-name:"[https://]HOST[:PORT][,OPTION=VALUE]"`
+	Headers        []string      `short:"H" long:"header"   description:"Set or replace request header in duplicated traffic." value-name:"LINE"`
+	Methods        []string      `short:"m" long:"method"   description:"Only forward requests with specific HTTP methods." value-name:"VERB"`
+	GRPCMethods    []string      `long:"grpc-method"        description:"Only forward gRPC calls to specific methods." value-name:"/PKG.SERVICE/METHOD"`
+	Multiply       float32       `short:"n" long:"multiply" description:"Increase or reduce the number of requests by a factor." value-name:"N"`
+	SampleKey      string        `long:"sample-key"         description:"Mirror either all or none of the requests with the same client IP, header or cookie value when multiplying." value-name:"ip|header:NAME|cookie:NAME"`
+	Sticky         string        `long:"sticky"             description:"Route requests with the same client IP, header or cookie value to the same weighted destination." value-name:"ip|header:NAME|cookie:NAME"`
+	DropIncomplete bool          `long:"drop-incomplete"    description:"Do not forward requests with data missing from the capture."`
+	StreamBodies   bool          `long:"stream-bodies"      description:"Forward request bodies to a single destination as they are captured, instead of reading them first."`
+	MaxBody        int64         `long:"max-body"           description:"Limit request bodies, and response bodies kept for diffing, to N bytes, 0 is unlimited." value-name:"N"`
+	BodyPolicy     string        `long:"body-policy"        description:"Handle bodies over the limit by spooling them to disk, truncating them or skipping the request." choice:"spool" choice:"truncate" choice:"skip" default:"spool"`
+	Read           string        `short:"r" long:"read"     description:"Read packets from a pcap/pcapng capture file instead of live interfaces." value-name:"FILE"`
+	Speed          float64       `long:"speed"              description:"Replay capture files at a factor of their original speed, 0 is as fast as possible." value-name:"N" default:"1"`
+	Record         string        `long:"record"             description:"Append captured HTTP requests to a request log file, bodies over --max-body are cut short and marked incomplete." value-name:"FILE"`
+	MaxPages       int           `long:"max-pages"          description:"Buffer at most N pages of out-of-order data in total, each page holds up to 1900 bytes." value-name:"N" default:"65536"`
+	MaxConnPages   int           `long:"max-conn-pages"     description:"Buffer at most N pages of out-of-order data per connection." value-name:"N" default:"4096"`
+	FlushInterval  time.Duration `long:"flush-interval"     description:"Check for idle connections at this interval." value-name:"DURATION" default:"1m"`
+	IdleTimeout    time.Duration `long:"idle-timeout"       description:"Give up on connections without data for this long." value-name:"DURATION" default:"2m"`
+	Responses      bool          `long:"responses"          description:"Also capture responses from the source(s) and report them with forwarded requests."`
+	Diff           bool          `long:"diff"               description:"Compare responses from destinations with production responses."`
+	DiffHeaders    []string      `long:"diff-header"        description:"Compare a response header when diffing." value-name:"NAME"`
+	DiffIgnore     []string      `long:"diff-ignore"        description:"Ignore a JSON body path when diffing, * matches any key or index." value-name:"PATH"`
+	DiffReport     string        `long:"diff-report"        description:"Append mismatching responses to a report file instead of logging them." value-name:"FILE"`
+	KeyLog         string        `long:"keylog"             description:"Decrypt TLS traffic with secrets from an SSLKEYLOGFILE key log." value-name:"FILE"`
+	Baseline       string        `long:"baseline"           description:"Baseline destination running production code, used to ignore nondeterministic differences." value-name:"HOST[:PORT]"`
+	Verbose        bool          `short:"v" long:"verbose"  description:"Show extra information, including all request headers."`
+	DestinationOptions
 }
 
 func NewWiretap(opts Options) *Wiretap {
-	sources, err := ResolveAddrPatterns(opts.Sources)
+	resolveSources := ResolveAddrPatterns
+	if opts.Read != "" {
+		/* Captures may come from another host, so wildcards must not be
+		   expanded to the addresses of local interfaces. */
+		resolveSources = ResolveAddrList
+	}
+
+	sources, err := resolveSources(opts.Sources)
 	if err != nil {
 		panic(err)
 	}
 
-	destinations, err := ResolveAddrList(opts.Destinations)
+	destinations, err := ResolveDestinations(opts.Destinations, CandidateRole)
 	if err != nil {
 		panic(err)
 	}
 
+	if opts.Baseline != "" {
+		baselines, err := ResolveDestinations([]string{opts.Baseline}, BaselineRole)
+		if err != nil {
+			panic(err)
+		}
+		destinations = append(destinations, baselines...)
+	}
+
+	if err := destinations.Configure(opts.DestinationOptions); err != nil {
+		panic(err)
+	}
+
 	headers := make(map[string]string)
 	for _, header := range opts.Headers {
 		parts := strings.SplitN(header, ":", 2)
@@ -61,24 +127,123 @@ func NewWiretap(opts Options) *Wiretap {
 		methods[strings.ToUpper(method)] = true
 	}
 
+	grpcMethods := make(map[string]bool)
+	for _, method := range opts.GRPCMethods {
+		grpcMethods[method] = true
+	}
+
+	sticky, err := ParseKey(opts.Sticky)
+	if err != nil {
+		panic(err)
+	}
+
+	sampleKey, err := ParseKey(opts.SampleKey)
+	if err != nil {
+		panic(err)
+	}
+
 	if opts.Multiply == 0 {
 		opts.Multiply = 1
 	}
 
-	return &Wiretap{
-		Sources:      sources,
-		Destinations: destinations,
-		Interfaces:   FindInterfaces(),
-		Headers:      headers,
-		Methods:      methods,
-		Multiply:     opts.Multiply,
-		RepeatDelay:  2 * time.Second,
-		Logger:       log.New(os.Stdout, "", log.LstdFlags),
-		Verbose:      opts.Verbose,
-		BufSize:      65535,
-		Timeout:      10 * time.Millisecond,
-		Transport:    http.Transport{MaxIdleConnsPerHost: 16},
+	if opts.MaxPages == 0 {
+		opts.MaxPages = 65536
+	}
+
+	if opts.MaxConnPages == 0 {
+		opts.MaxConnPages = 4096
+	}
+
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = time.Minute
+	}
+
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 2 * time.Minute
 	}
+
+	if opts.MaxPages < 0 || opts.MaxConnPages < 0 {
+		panic("page limits must be positive")
+	}
+
+	if opts.FlushInterval < 0 || opts.IdleTimeout < 0 {
+		panic("flush interval and idle timeout must be positive")
+	}
+
+	var recorder *Recorder
+	if opts.Record != "" {
+		if recorder, err = NewRecorder(opts.Record); err != nil {
+			panic(err)
+		}
+	}
+
+	var keyLog *KeyLog
+	if opts.KeyLog != "" {
+		if keyLog, err = LoadKeyLog(opts.KeyLog); err != nil {
+			panic(err)
+		}
+	}
+
+	var differ *Differ
+	var reporter *Reporter
+	if opts.Diff {
+		differ = NewDiffer(opts.DiffHeaders, opts.DiffIgnore)
+		if opts.DiffReport != "" {
+			if reporter, err = NewReporter(opts.DiffReport); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	tap := &Wiretap{
+		Sources:         sources,
+		Destinations:    destinations,
+		Interfaces:      FindInterfaces(),
+		ReadFile:        opts.Read,
+		Speed:           opts.Speed,
+		Headers:         headers,
+		Methods:         methods,
+		GRPCMethods:     grpcMethods,
+		Sticky:          sticky,
+		SampleKey:       sampleKey,
+		Multiply:        opts.Multiply,
+		DropIncomplete:  opts.DropIncomplete,
+		StreamBodies:    opts.StreamBodies,
+		MaxBody:         opts.MaxBody,
+		BodyPolicy:      opts.BodyPolicy,
+		Recorder:        recorder,
+		Differ:          differ,
+		Reporter:        reporter,
+		RepeatDelay:     2 * time.Second,
+		Logger:          log.New(os.Stdout, "", log.LstdFlags),
+		Verbose:         opts.Verbose,
+		BufSize:         65535,
+		Timeout:         10 * time.Millisecond,
+		MaxPages:        opts.MaxPages,
+		MaxConnPages:    opts.MaxConnPages,
+		FlushInterval:   opts.FlushInterval,
+		IdleTimeout:     opts.IdleTimeout,
+		Responses:       opts.Responses || opts.Diff || keyLog != nil,
+		KeyLog:          keyLog,
+		ResponseTimeout: 10 * time.Second,
+		Stats:           new(Stats),
+		conns:           make(map[[2]gopacket.Flow]*Conn),
+	}
+
+	for _, dst := range destinations {
+		dst := dst
+		dst.Breaker.OnChange = func(state string) {
+			tap.Log("Circuit for %s is %s", dst, state)
+		}
+
+		/* Packets read from a file can wait for a worker instead of being
+		   dropped, as fast as they are read. */
+		if tap.ReadFile != "" {
+			dst.Queue.Block = true
+		}
+	}
+
+	return tap
 }
 
 func PcapVersion() string {
@@ -89,40 +254,170 @@ func (tap *Wiretap) Start() {
 	pool := tcpassembly.NewStreamPool(tap)
 	assembler := tcpassembly.NewAssembler(pool)
 
+	/* Data beyond these limits is skipped and reported as lost. */
+	assembler.MaxBufferedPagesTotal = tap.MaxPages
+	assembler.MaxBufferedPagesPerConnection = tap.MaxConnPages
+
 	packets := tap.packets()
-	ticker := time.Tick(time.Minute)
+	ticker := time.Tick(tap.FlushInterval)
 
-	if tap.Verbose {
-		fmt.Fprintf(os.Stderr, "Listening on interfaces %s\n", strings.Join(tap.Interfaces, ", "))
-	}
+	pacer := &Pacer{Speed: tap.Speed}
+	var flushed time.Time
 
-	fmt.Fprintf(os.Stderr, "Wiretapping HTTP traffic to %s and forwarding to %s...\n", tap.Sources, tap.Destinations)
+	if tap.ReadFile != "" {
+		fmt.Fprintf(os.Stderr, "Reading HTTP traffic to %s from %s and %s...\n", tap.Sources, tap.ReadFile, tap.actions())
+	} else {
+		if tap.Verbose {
+			fmt.Fprintf(os.Stderr, "Listening on interfaces %s\n", strings.Join(tap.Interfaces, ", "))
+		}
+
+		fmt.Fprintf(os.Stderr, "Wiretapping HTTP traffic to %s and %s...\n", tap.Sources, tap.actions())
+	}
 
 	for {
 		select {
-		case packet := <-packets:
-			assembler.Assemble(
+		case packet, ok := <-packets:
+			if !ok {
+				/* End of capture file; wait for all requests to be forwarded. */
+				assembler.FlushAll()
+				tap.pending.Wait()
+				if tap.Recorder != nil {
+					tap.Recorder.Close()
+				}
+				if tap.Reporter != nil {
+					tap.Reporter.Close()
+				}
+				fmt.Fprintf(os.Stderr, "Finished reading %s (%s)\n", tap.ReadFile, tap.Stats)
+				return
+			}
+
+			timestamp := packet.Metadata().Timestamp
+			if tap.ReadFile != "" {
+				pacer.Wait(timestamp)
+
+				/* Capture files are flushed by capture time rather than wall time. */
+				if timestamp.Sub(flushed) > tap.FlushInterval {
+					assembler.FlushOlderThan(timestamp.Add(-tap.IdleTimeout))
+					flushed = timestamp
+				}
+			}
+
+			assembler.AssembleWithTimestamp(
 				packet.NetworkLayer().NetworkFlow(),
-				packet.TransportLayer().(*layers.TCP))
+				packet.TransportLayer().(*layers.TCP),
+				timestamp)
 		case <-ticker:
-			assembler.FlushOlderThan(time.Now().Add(-2 * time.Minute))
+			if tap.ReadFile == "" {
+				assembler.FlushOlderThan(time.Now().Add(-tap.IdleTimeout))
+			}
+			if tap.Verbose {
+				tap.logStats()
+			}
 		}
 	}
 }
 
 func (tap *Wiretap) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
-	stream := NewStream(tap, netFlow, tcpFlow)
-	go stream.Consume()
+	var stream interface {
+		tcpassembly.Stream
+		Consume()
+	}
+
+	if !tap.Responses {
+		stream = NewStream(tap, netFlow, tcpFlow, nil)
+		tap.consume(stream.Consume)
+		return stream
+	}
+
+	/* Both directions of a connection share the same key. */
+	key := [2]gopacket.Flow{netFlow, tcpFlow}
+	fromSource := tap.Sources.Contains(net.IP(netFlow.Src().Raw()), int(binary.BigEndian.Uint16(tcpFlow.Src().Raw())))
+	if fromSource {
+		key = [2]gopacket.Flow{netFlow.Reverse(), tcpFlow.Reverse()}
+	}
+
+	conn := tap.acquireConn(key)
+	if fromSource {
+		stream = NewResponseStream(tap, netFlow, conn)
+	} else {
+		stream = NewStream(tap, netFlow, tcpFlow, conn)
+	}
+
+	tap.consume(func() {
+		defer tap.releaseConn(key)
+		stream.Consume()
+	})
 	return stream
 }
 
+func (tap *Wiretap) consume(consume func()) {
+	tap.pending.Add(1)
+	go func() {
+		defer tap.pending.Done()
+		consume()
+	}()
+}
+
+func (tap *Wiretap) acquireConn(key [2]gopacket.Flow) *Conn {
+	tap.connMutex.Lock()
+	defer tap.connMutex.Unlock()
+
+	conn, ok := tap.conns[key]
+	if !ok {
+		conn = new(Conn)
+		tap.conns[key] = conn
+	}
+	conn.refs++
+	return conn
+}
+
+func (tap *Wiretap) releaseConn(key [2]gopacket.Flow) {
+	tap.connMutex.Lock()
+	defer tap.connMutex.Unlock()
+
+	if conn := tap.conns[key]; conn != nil {
+		if conn.refs--; conn.refs == 0 {
+			delete(tap.conns, key)
+		}
+	}
+}
+
 func (tap *Wiretap) Log(fmt string, args ...interface{}) {
 	tap.Logger.Printf(fmt+"\n", args...)
 }
 
+func (tap *Wiretap) logStats() {
+	tap.Log("Stats: %s", tap.Stats)
+	for _, dst := range tap.Destinations {
+		tap.Log("Stats: %d queued, %d dropped for %s", dst.Queue.Depth(), atomic.LoadInt64(&dst.Dropped), dst)
+	}
+}
+
+func (tap *Wiretap) actions() string {
+	var actions []string
+	if len(tap.Destinations) > 0 {
+		actions = append(actions, fmt.Sprintf("forwarding to %s", tap.Destinations))
+	}
+	if tap.Recorder != nil {
+		actions = append(actions, fmt.Sprintf("recording to %s", tap.Recorder.Path))
+	}
+	return strings.Join(actions, " and ")
+}
+
+func (tap *Wiretap) filter() string {
+	if tap.Responses {
+		return tap.Sources.FilterWithResponses()
+	}
+	return tap.Sources.Filter()
+}
+
 func (tap *Wiretap) packets() chan gopacket.Packet {
+	if tap.ReadFile != "" {
+		return tap.readPackets()
+	}
+
 	channel := make(chan gopacket.Packet, 100)
-	filter := tap.Sources.Filter()
+	filter := tap.filter()
 
 	n := 0
 	for _, intf := range tap.Interfaces {
@@ -148,6 +443,28 @@ func (tap *Wiretap) packets() chan gopacket.Packet {
 	return channel
 }
 
+func (tap *Wiretap) readPackets() chan gopacket.Packet {
+	channel := make(chan gopacket.Packet, 100)
+
+	/* Offline handles read pcapng files as well, if libpcap supports them. */
+	handle, err := pcap.OpenOffline(tap.ReadFile)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := handle.SetBPFFilter(tap.filter()); err != nil {
+		handle.Close()
+		panic(err)
+	}
+
+	go func() {
+		tap.capture(handle, channel)
+		close(channel)
+	}()
+
+	return channel
+}
+
 func (tap *Wiretap) capture(handle *pcap.Handle, channel chan gopacket.Packet) {
 	defer handle.Close()
 
@@ -160,6 +477,10 @@ func (tap *Wiretap) capture(handle *pcap.Handle, channel chan gopacket.Packet) {
 			return
 		} else if err == nil {
 			channel <- packet
+		} else if tap.ReadFile != "" {
+			/* Read errors on capture files are not transient. */
+			tap.Log("Error: %s", err)
+			return
 		}
 	}
 }
@@ -23,10 +23,42 @@ func TestNewWiretapOptions(t *testing.T) {
 
 	assert.Equal(t, tap.BufSize, int32(65535))
 	assert.Equal(t, tap.Timeout, time.Second/100)
+	assert.Equal(t, tap.FlushInterval, time.Minute)
+	assert.Equal(t, tap.IdleTimeout, 2*time.Minute)
+	assert.Equal(t, tap.MaxPages, 65536)
+	assert.Equal(t, tap.MaxConnPages, 4096)
 
 	assert.NotNil(t, tap.Log)
 }
 
+func TestNewWiretapReassemblyLimits(t *testing.T) {
+	tap := NewWiretap(Options{MaxPages: 1000, MaxConnPages: 10, FlushInterval: time.Second, IdleTimeout: 5 * time.Second})
+
+	assert.Equal(t, tap.MaxPages, 1000)
+	assert.Equal(t, tap.MaxConnPages, 10)
+	assert.Equal(t, tap.FlushInterval, time.Second)
+	assert.Equal(t, tap.IdleTimeout, 5*time.Second)
+
+	assert.Panics(t, func() { NewWiretap(Options{FlushInterval: -time.Second}) })
+	assert.Panics(t, func() { NewWiretap(Options{IdleTimeout: -time.Second}) })
+	assert.Panics(t, func() { NewWiretap(Options{MaxConnPages: -1}) })
+}
+
+func TestNewWiretapReadKeepsWildcardSources(t *testing.T) {
+	tap := NewWiretap(Options{Sources: []string{"*:8080"}, Read: "capture.pcap"})
+
+	assert.Equal(t, tap.ReadFile, "capture.pcap")
+	assert.Equal(t, tap.Sources, AddrList{&net.TCPAddr{IP: net.IP(nil), Port: 8080}})
+}
+
+func TestNewWiretapReadBlocksQueues(t *testing.T) {
+	tap := NewWiretap(Options{Destinations: []string{"127.0.0.1:8080"}, Read: "capture.pcap"})
+	assert.True(t, tap.Destinations[0].Queue.Block)
+
+	tap = NewWiretap(Options{Destinations: []string{"127.0.0.1:8080"}})
+	assert.False(t, tap.Destinations[0].Queue.Block)
+}
+
 func TestPcapVersion(t *testing.T) {
 	assert.Contains(t, PcapVersion(), "libpcap version")
 }
@@ -69,7 +101,7 @@ func TestStartWiretapForwardsBody(t *testing.T) {
 	assert.Equal(t, string(copy.consumedBody), "FOO BAR BAZ")
 }
 
-/* Note: HTTP client does not support 100 continue/delayed body submission yet. */
+/* The body follows the interim response. */
 func TestStartWiretapForwardsBodyAfterHttpContinue(t *testing.T) {
 	orig, copy := performHttpWiretap(Options{}, func(host string) {
 		client := &http.Client{}
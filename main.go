@@ -18,7 +18,11 @@ type options struct {
 	Version bool `long:"version" description:"Display version number and exit."`
 }
 
-var parser *flags.Parser
+type replayOptions struct {
+	httap.ReplayOptions
+	Help bool `long:"help" description:"Display this help and exit."`
+}
+
 var buildTag string
 
 func writeVersion() {
@@ -28,9 +32,10 @@ func writeVersion() {
 		httap.PcapVersion(), runtime.Version())
 }
 
-func writeHelp() {
-	fmt.Fprintln(os.Stderr, "Wiretaps and forwards HTTP traffic\n")
+func writeHelp(parser *flags.Parser, description string) {
+	fmt.Fprintln(os.Stderr, description+"\n")
 	parser.WriteHelp(os.Stderr)
+	fmt.Fprintln(os.Stderr, "\n"+httap.DestinationHelp)
 }
 
 func reportError() {
@@ -52,25 +57,62 @@ func init() {
 func main() {
 	defer reportError()
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+	} else {
+		wiretap(os.Args[1:])
+	}
+}
+
+func wiretap(args []string) {
 	var opts struct {
 		options `group:"Options"`
 	}
 
-	parser = flags.NewParser(&opts, flags.None)
-	parser.Usage = "[OPTIONS] [--src HOST:PORT ...] --dst HOST:PORT ..."
-	_, err := parser.Parse()
+	parser := flags.NewParser(&opts, flags.None)
+	parser.Usage = "[OPTIONS] [--src HOST:PORT ...] {--dst HOST:PORT ... | --record FILE}\n" +
+		"  " + parser.Name + " replay [OPTIONS] --dst HOST:PORT ... FILE"
+	_, err := parser.ParseArgs(args)
 
-	if len(os.Args) == 1 {
+	if len(args) == 0 {
 		opts.Help = true
 	}
 
 	if opts.Version {
 		writeVersion()
 	} else if opts.Help {
-		writeHelp()
+		writeHelp(parser, "Wiretaps and forwards HTTP traffic")
 	} else if err != nil {
 		panic(err)
+	} else if len(opts.Destinations) == 0 && opts.Record == "" {
+		panic("no destination or request log specified, use --dst or --record")
 	} else {
 		httap.NewWiretap(opts.Options).Start()
 	}
 }
+
+func replay(args []string) {
+	var opts struct {
+		replayOptions `group:"Options"`
+		Args          struct {
+			File string `positional-arg-name:"FILE"`
+		} `positional-args:"yes" required:"yes"`
+	}
+
+	parser := flags.NewParser(&opts, flags.None)
+	parser.Name = path.Base(os.Args[0]) + " replay"
+	parser.Usage = "[OPTIONS] --dst HOST:PORT ..."
+	_, err := parser.ParseArgs(args)
+
+	if len(args) == 0 {
+		opts.Help = true
+	}
+
+	if opts.Help {
+		writeHelp(parser, "Replays a request log and forwards it as HTTP traffic")
+	} else if err != nil {
+		panic(err)
+	} else {
+		httap.NewReplay(opts.Args.File, opts.ReplayOptions).Start()
+	}
+}